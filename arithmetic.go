@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kiasaki/ush/parser"
+)
+
+// Operators of arithmetic expressions, longest first so that the first match
+// wins
+var arithmeticOperators = []string{
+	"<<=", ">>=",
+	"**", "++", "--", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"*=", "/=", "%=", "+=", "-=", "&=", "^=", "|=",
+	"+", "-", "*", "/", "%", "<", ">", "=", "!", "~", "&", "^", "|",
+	"?", ":", ",", "(", ")",
+}
+
+// Assignment operators, `a += b` being the same as `a = a + b`
+var arithmeticAssignments = []string{"=", "*=", "/=", "%=", "+=", "-=", "<<=", ">>=", "&=", "^=", "|="}
+
+// Left-associative binary operators, from the lowest precedence to the
+// highest
+var arithmeticPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", ">", "<=", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// Variables whose values are expressions are evaluated recursively, up to
+// this depth
+const maxArithmeticDepth = 1024
+
+// arithmetic evaluates an arithmetic expression with 64-bit integers, like
+// C does, as it parses it
+type arithmetic struct {
+	s      *State
+	expr   string
+	tokens []string
+	pos    int
+	depth  int
+	skip   int // > 0 within operands that aren't evaluated, like b in `0 && b`
+	err    error
+}
+
+// Expands parameters and command substitutions in an arithmetic expression,
+// then evaluates it, returning its value
+func (s *State) expandArithmetic(expr string) (string, error) {
+	word, err := parser.ParseWord(expr)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	for _, part := range word {
+		value := part.Value
+		if part.Substitution || part.Arithmetic {
+			value, err = s.substitute(part)
+		} else if part.Quoting != parser.SingleQuoted {
+			value, err = s.expandVariables(value)
+		}
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(value)
+	}
+	n, err := s.evalArithmetic(buf.String(), 0)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+// Evaluates an arithmetic expression that has already been expanded, an
+// empty one being 0
+func (s *State) evalArithmetic(expr string, depth int) (int64, error) {
+	if depth > maxArithmeticDepth {
+		return 0, fmt.Errorf("%s: expression recursion level exceeded", expr)
+	}
+	tokens, err := splitArithmetic(expr)
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+	p := &arithmetic{s: s, expr: expr, tokens: tokens, depth: depth}
+	n := p.parseComma()
+	if p.err == nil && !p.done() {
+		p.syntaxError()
+	}
+	return n, p.err
+}
+
+// Splits an arithmetic expression into numbers, names and operators
+func splitArithmetic(expr string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		if c == ' ' || c == '\t' || c == '\n' {
+			i++
+			continue
+		}
+		if isDigit(c) || isNameStart(c) {
+			end := i + 1
+			for end < len(expr) && (isDigit(expr[end]) || isNameStart(expr[end]) ||
+				(isDigit(c) && (expr[end] == '#' || expr[end] == '@'))) {
+				end++
+			}
+			tokens = append(tokens, expr[i:end])
+			i = end
+			continue
+		}
+		op := ""
+		for _, o := range arithmeticOperators {
+			if strings.HasPrefix(expr[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("%s: syntax error: invalid arithmetic operator (error token is \"%s\")", expr, expr[i:])
+		}
+		tokens = append(tokens, op)
+		i += len(op)
+	}
+	return tokens, nil
+}
+
+// Parses a number like 42, 0x2a, 052 or 16#2a, returning false if text isn't
+// a valid one
+func parseArithmeticNumber(text string) (int64, bool) {
+	base := int64(10)
+	digits := text
+	if i := strings.IndexByte(text, '#'); i != -1 {
+		b, err := strconv.Atoi(text[:i])
+		if err != nil || b < 2 || b > 64 {
+			return 0, false
+		}
+		base, digits = int64(b), text[i+1:]
+	} else if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		base, digits = 16, text[2:]
+	} else if len(text) > 1 && text[0] == '0' {
+		base, digits = 8, text[1:]
+	}
+	if digits == "" {
+		return 0, false
+	}
+
+	n := int64(0)
+	for i := 0; i < len(digits); i++ {
+		c := digits[i]
+		d := int64(-1)
+		switch {
+		case isDigit(c):
+			d = int64(c - '0')
+		case c >= 'a' && c <= 'z':
+			d = int64(c-'a') + 10
+		case c >= 'A' && c <= 'Z':
+			d = int64(c-'A') + 10
+			if base > 36 {
+				d += 26
+			}
+		case c == '@':
+			d = 62
+		case c == '_':
+			d = 63
+		}
+		if d < 0 || d >= base {
+			return 0, false
+		}
+		n = n*base + d
+	}
+	return n, true
+}
+
+func (p *arithmetic) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *arithmetic) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+// Consumes the next token if it is one of ops, returning it
+func (p *arithmetic) accept(ops ...string) string {
+	if p.err != nil || p.done() {
+		return ""
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos] == op {
+			p.pos++
+			return op
+		}
+	}
+	return ""
+}
+
+// Records the first error met, evaluation stopping there
+func (p *arithmetic) fail(format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf("%s: "+format, append([]interface{}{p.expr}, args...)...)
+	}
+}
+
+func (p *arithmetic) syntaxError() {
+	if p.done() {
+		p.fail("syntax error: operand expected")
+	} else {
+		p.fail("syntax error in expression (error token is \"%s\")", strings.Join(p.tokens[p.pos:], " "))
+	}
+}
+
+// expression , expression
+func (p *arithmetic) parseComma() int64 {
+	n := p.parseAssignment()
+	for p.accept(",") != "" {
+		n = p.parseAssignment()
+	}
+	return n
+}
+
+// name = expression, and the other assignment operators like +=
+func (p *arithmetic) parseAssignment() int64 {
+	if p.pos+1 >= len(p.tokens) || !isName(p.tokens[p.pos]) {
+		return p.parseConditional()
+	}
+	name, op := p.tokens[p.pos], p.tokens[p.pos+1]
+	for _, assignment := range arithmeticAssignments {
+		if op != assignment {
+			continue
+		}
+		p.pos += 2
+		value := p.parseAssignment()
+		if op != "=" {
+			value = p.apply(op[:len(op)-1], p.variable(name), value)
+		}
+		p.assign(name, value)
+		return value
+	}
+	return p.parseConditional()
+}
+
+// condition ? expression : expression
+func (p *arithmetic) parseConditional() int64 {
+	n := p.parseBinary(0)
+	if p.accept("?") == "" {
+		return n
+	}
+	if n == 0 {
+		p.skip++
+	}
+	a := p.parseAssignment()
+	if n == 0 {
+		p.skip--
+	}
+	if p.accept(":") == "" {
+		p.syntaxError()
+		return 0
+	}
+	if n != 0 {
+		p.skip++
+	}
+	b := p.parseAssignment()
+	if n != 0 {
+		p.skip--
+		return a
+	}
+	return b
+}
+
+// Binary operators with a precedence of level and above
+func (p *arithmetic) parseBinary(level int) int64 {
+	if level == len(arithmeticPrecedence) {
+		return p.parsePower()
+	}
+	n := p.parseBinary(level + 1)
+	for {
+		op := p.accept(arithmeticPrecedence[level]...)
+		if op == "" {
+			return n
+		}
+		// The right side of && and || is only evaluated when needed
+		shortCircuit := (op == "&&" && n == 0) || (op == "||" && n != 0)
+		if shortCircuit {
+			p.skip++
+		}
+		m := p.parseBinary(level + 1)
+		if shortCircuit {
+			p.skip--
+		}
+		n = p.apply(op, n, m)
+	}
+}
+
+// base ** exponent, which is right-associative
+func (p *arithmetic) parsePower() int64 {
+	n := p.parseUnary()
+	if p.accept("**") == "" {
+		return n
+	}
+	return p.apply("**", n, p.parsePower())
+}
+
+// Prefix operators
+func (p *arithmetic) parseUnary() int64 {
+	switch op := p.accept("+", "-", "!", "~", "++", "--"); op {
+	case "+":
+		return p.parseUnary()
+	case "-":
+		return -p.parseUnary()
+	case "!":
+		if p.parseUnary() == 0 {
+			return 1
+		}
+		return 0
+	case "~":
+		return ^p.parseUnary()
+	case "++", "--":
+		name := p.peek()
+		if !isName(name) {
+			p.fail("attempted assignment to non-variable (error token is \"%s\")", name)
+			return 0
+		}
+		p.pos++
+		n := p.variable(name) + 1
+		if op == "--" {
+			n -= 2
+		}
+		p.assign(name, n)
+		return n
+	}
+	return p.parsePostfix()
+}
+
+// Numbers, variables, optionally followed by ++ or --, and parentheses
+func (p *arithmetic) parsePostfix() int64 {
+	if p.err != nil {
+		return 0
+	}
+	if p.accept("(") != "" {
+		n := p.parseComma()
+		if p.accept(")") == "" {
+			p.fail("missing `)'")
+		}
+		return n
+	}
+
+	token := p.peek()
+	if isName(token) {
+		p.pos++
+		n := p.variable(token)
+		if op := p.accept("++", "--"); op == "++" {
+			p.assign(token, n+1)
+		} else if op == "--" {
+			p.assign(token, n-1)
+		}
+		return n
+	}
+	if token != "" && isDigit(token[0]) {
+		p.pos++
+		n, ok := parseArithmeticNumber(token)
+		if !ok {
+			p.fail("invalid number (error token is \"%s\")", token)
+		}
+		return n
+	}
+	p.syntaxError()
+	return 0
+}
+
+// Applies a binary operator
+func (p *arithmetic) apply(op string, a, b int64) int64 {
+	switch op {
+	case "||":
+		return boolToInt(a != 0 || b != 0)
+	case "&&":
+		return boolToInt(a != 0 && b != 0)
+	case "|":
+		return a | b
+	case "^":
+		return a ^ b
+	case "&":
+		return a & b
+	case "==":
+		return boolToInt(a == b)
+	case "!=":
+		return boolToInt(a != b)
+	case "<":
+		return boolToInt(a < b)
+	case ">":
+		return boolToInt(a > b)
+	case "<=":
+		return boolToInt(a <= b)
+	case ">=":
+		return boolToInt(a >= b)
+	case "<<":
+		return a << (uint64(b) & 63)
+	case ">>":
+		return a >> (uint64(b) & 63)
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/", "%":
+		if b == 0 {
+			if p.skip == 0 {
+				p.fail("division by 0")
+			}
+			return 0
+		}
+		if op == "/" {
+			return a / b
+		}
+		return a % b
+	case "**":
+		if b < 0 {
+			if p.skip == 0 {
+				p.fail("exponent less than 0")
+			}
+			return 0
+		}
+		// Exponentiation by squaring
+		n := int64(1)
+		for ; b > 0; b >>= 1 {
+			if b&1 == 1 {
+				n *= a
+			}
+			a *= a
+		}
+		return n
+	}
+	return 0
+}
+
+// Returns the value of a variable, which is evaluated when it's an
+// expression, unset and empty variables being 0
+func (p *arithmetic) variable(name string) int64 {
+	value := strings.TrimSpace(p.s.getVar(name))
+	if value == "" || p.err != nil {
+		return 0
+	}
+	if n, ok := parseArithmeticNumber(value); ok {
+		return n
+	}
+	n, err := p.s.evalArithmetic(value, p.depth+1)
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+	return n
+}
+
+// Sets a variable, unless within an operand that isn't evaluated
+func (p *arithmetic) assign(name string, n int64) {
+	if p.skip > 0 || p.err != nil {
+		return
+	}
+	if err := p.s.setVar(name, strconv.FormatInt(n, 10)); err != nil {
+		p.fail("%v", err)
+	}
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Returns the exit status of an arithmetic command, 0 when its value isn't
+// zero and 1 when it is
+func arithmeticStatus(value string) int {
+	if value == "0" {
+		return 1
+	}
+	return 0
+}
+
+// Evaluates each argument as an arithmetic expression
+func (s *State) BuiltinLet(args []string) int {
+	if len(args) < 2 {
+		return s.ReportCommandError("let needs at least 1 argument")
+	}
+	value := ""
+	for _, expr := range args[1:] {
+		n, err := s.evalArithmetic(expr, 0)
+		if err != nil {
+			return s.ReportCommandError("let: %v", err)
+		}
+		value = strconv.FormatInt(n, 10)
+	}
+	return arithmeticStatus(value)
+}
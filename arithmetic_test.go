@@ -0,0 +1,102 @@
+package main
+
+import "testing"
+
+func TestEvalArithmetic(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int64
+	}{
+		{"", 0},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"7 / 2", 3},
+		{"-7 % 3", -1},
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 3", -8},
+		{"2 ** 0", 1},
+		{"0 ** 0", 1},
+		{"1 ** 9000000000000", 1},
+		{"-1 ** 9000000000001", -1},
+		{"2 ** 63", -9223372036854775808},
+		{"2 ** 64", 0},
+		{"3 ** 40", 12157665459056928801 - 1<<64},
+		{"1 << 65", 2},
+		{"9223372036854775807 + 1", -9223372036854775808},
+		{"0x1f + 010 + 2#101 + 16#ff", 31 + 8 + 5 + 255},
+		{"!0 + !5 + ~0", 0},
+		{"1 < 2 && 2 <= 2 || 0", 1},
+		{"0 && 1 / 0", 0},
+		{"1 || 1 % 0", 1},
+		{"1 ? 2 : 1 / 0", 2},
+		{"0 ? 1 / 0 : 3", 3},
+		{"1, 2, 3", 3},
+		{"x = 5, x *= 2, x++, x", 11},
+	}
+	for _, test := range tests {
+		s := NewState()
+		got, err := s.evalArithmetic(test.expr, 0)
+		if err != nil {
+			t.Errorf("evalArithmetic(%q) failed: %v", test.expr, err)
+		} else if got != test.want {
+			t.Errorf("evalArithmetic(%q) = %d, want %d", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestEvalArithmeticErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"5 % 0", "5 % 0: division by 0"},
+		{"5 / 0", "5 / 0: division by 0"},
+		{"2 ** -1", "2 ** -1: exponent less than 0"},
+		{"(1 + 2", "(1 + 2: missing `)'"},
+		{"1 +", "1 +: syntax error: operand expected"},
+		{"1 2", "1 2: syntax error in expression (error token is \"2\")"},
+		{"09", "09: invalid number (error token is \"09\")"},
+		{"1 $ 2", "1 $ 2: syntax error: invalid arithmetic operator (error token is \"$ 2\")"},
+		{"++5", "++5: attempted assignment to non-variable (error token is \"5\")"},
+	}
+	for _, test := range tests {
+		s := NewState()
+		if _, err := s.evalArithmetic(test.expr, 0); err == nil {
+			t.Errorf("evalArithmetic(%q) succeeded, want error %q", test.expr, test.want)
+		} else if err.Error() != test.want {
+			t.Errorf("evalArithmetic(%q) failed with %q, want %q", test.expr, err, test.want)
+		}
+	}
+}
+
+func TestEvalArithmeticVariables(t *testing.T) {
+	s := NewState()
+	s.setVar("a", "3")
+	s.setVar("b", "a * 2")
+	s.setVar("c", "")
+	tests := []struct {
+		expr string
+		want int64
+	}{
+		{"a + 1", 4},
+		{"b + 1", 7},
+		{"c + unset", 0},
+		{"a += 2", 5},
+		{"a", 5},
+		{"--a", 4},
+		{"a--", 4},
+		{"a", 3},
+	}
+	for _, test := range tests {
+		got, err := s.evalArithmetic(test.expr, 0)
+		if err != nil {
+			t.Errorf("evalArithmetic(%q) failed: %v", test.expr, err)
+		} else if got != test.want {
+			t.Errorf("evalArithmetic(%q) = %d, want %d", test.expr, got, test.want)
+		}
+	}
+	if got := s.getVar("a"); got != "3" {
+		t.Errorf("a = %q after evaluating, want \"3\"", got)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kiasaki/ush/parser"
+)
+
+// Sequences of `{x..y}` and `{x..y..step}` brace expressions
+var (
+	numberSequence    = regexp.MustCompile(`^([-+]?\d+)\.\.([-+]?\d+)(?:\.\.([-+]?\d+))?$`)
+	characterSequence = regexp.MustCompile(`^([a-zA-Z])\.\.([a-zA-Z])(?:\.\.([-+]?\d+))?$`)
+)
+
+// Expands the brace expressions of a word into the words they stand for, as
+// `a{b,c}` stands for `ab ac` and `{1..3}` for `1 2 3`. Only unquoted braces
+// count, and braces without a matching one or without a comma or sequence
+// between them are left untouched.
+func expandBraces(word parser.Word) []parser.Word {
+	units := braceUnits(word)
+	if units == nil {
+		return []parser.Word{word}
+	}
+	words := []parser.Word{}
+	for _, expanded := range expandBraceUnits(units) {
+		words = append(words, joinBraceUnits(expanded))
+	}
+	return words
+}
+
+// Splits a word in parts of a single unquoted character, which can be part of
+// brace expressions, keeping other parts and `${...}` whole. Returns nil when
+// the word has no unquoted opening brace.
+func braceUnits(word parser.Word) []parser.WordPart {
+	hasBrace := false
+	for _, part := range word {
+		hasBrace = hasBrace || (isBraceText(part) && strings.Contains(part.Value, "{"))
+	}
+	if !hasBrace {
+		return nil
+	}
+
+	units := []parser.WordPart{}
+	for _, part := range word {
+		if !isBraceText(part) {
+			units = append(units, part)
+			continue
+		}
+		for text := part.Value; len(text) > 0; {
+			n := 1
+			if strings.HasPrefix(text, "${") {
+				if end, err := parser.ParameterEnd(text[2:]); err == nil {
+					n = 2 + end
+				}
+			}
+			units = append(units, parser.WordPart{Value: text[:n]})
+			text = text[n:]
+		}
+	}
+	return units
+}
+
+// Returns true for the unquoted text of a word, in which braces are special
+func isBraceText(part parser.WordPart) bool {
+	return part.Quoting == parser.Unquoted && !part.Substitution && !part.Arithmetic
+}
+
+func isBraceUnit(unit parser.WordPart, c string) bool {
+	return isBraceText(unit) && unit.Value == c
+}
+
+// Expands the first brace expression of units, and the ones of the resulting
+// words, in order
+func expandBraceUnits(units []parser.WordPart) [][]parser.WordPart {
+	for start := range units {
+		if !isBraceUnit(units[start], "{") {
+			continue
+		}
+		end, commas := matchingBrace(units, start)
+		if end == -1 {
+			continue
+		}
+
+		var alternatives [][]parser.WordPart
+		if len(commas) > 0 {
+			from := start + 1
+			for _, comma := range append(commas, end) {
+				alternatives = append(alternatives, units[from:comma])
+				from = comma + 1
+			}
+		} else if alternatives = braceSequence(units[start+1 : end]); alternatives == nil {
+			continue
+		}
+
+		expanded := [][]parser.WordPart{}
+		for _, alternative := range alternatives {
+			word := append(append(append([]parser.WordPart{}, units[:start]...), alternative...), units[end+1:]...)
+			expanded = append(expanded, expandBraceUnits(word)...)
+		}
+		return expanded
+	}
+	return [][]parser.WordPart{units}
+}
+
+// Returns the index of the brace closing the one at units[start] and of the
+// commas directly within them, -1 if it isn't closed
+func matchingBrace(units []parser.WordPart, start int) (int, []int) {
+	depth := 0
+	commas := []int{}
+	for i := start; i < len(units); i++ {
+		switch {
+		case isBraceUnit(units[i], "{"):
+			depth++
+		case isBraceUnit(units[i], "}"):
+			depth--
+			if depth == 0 {
+				return i, commas
+			}
+		case isBraceUnit(units[i], ",") && depth == 1:
+			commas = append(commas, i)
+		}
+	}
+	return -1, nil
+}
+
+// Returns the words of a `x..y` or `x..y..step` sequence of numbers or
+// letters, nil if units isn't one. Numbers are zero-padded to the same width
+// when either end is.
+func braceSequence(units []parser.WordPart) [][]parser.WordPart {
+	var buf strings.Builder
+	for _, unit := range units {
+		if !isBraceText(unit) {
+			return nil
+		}
+		buf.WriteString(unit.Value)
+	}
+	text := buf.String()
+
+	values := []string{}
+	if m := numberSequence.FindStringSubmatch(text); m != nil {
+		from, err1 := strconv.Atoi(m[1])
+		to, err2 := strconv.Atoi(m[2])
+		step, err3 := braceStep(m[3])
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil
+		}
+		width := 0
+		if isZeroPadded(m[1]) || isZeroPadded(m[2]) {
+			width = len(m[1])
+			if len(m[2]) > width {
+				width = len(m[2])
+			}
+		}
+		for _, n := range sequence(from, to, step) {
+			digits := strings.TrimPrefix(strconv.Itoa(n), "-")
+			if n < 0 {
+				values = append(values, "-"+padNumber(digits, width-1))
+			} else {
+				values = append(values, padNumber(digits, width))
+			}
+		}
+	} else if m := characterSequence.FindStringSubmatch(text); m != nil {
+		step, err := braceStep(m[3])
+		if err != nil {
+			return nil
+		}
+		for _, c := range sequence(int(m[1][0]), int(m[2][0]), step) {
+			values = append(values, string(rune(c)))
+		}
+	} else {
+		return nil
+	}
+
+	words := make([][]parser.WordPart, len(values))
+	for i, value := range values {
+		words[i] = []parser.WordPart{{Value: value}}
+	}
+	return words
+}
+
+// Parses the step of a sequence, 1 when not given, its sign being ignored
+func braceStep(text string) (int, error) {
+	if text == "" {
+		return 1, nil
+	}
+	step, err := strconv.Atoi(text)
+	if step < 0 {
+		step = -step
+	}
+	if step == 0 {
+		step = 1
+	}
+	return step, err
+}
+
+// Returns true for numbers written with leading zeros, like `01` or `-05`
+func isZeroPadded(number string) bool {
+	number = strings.TrimLeft(number, "-+")
+	return len(number) > 1 && number[0] == '0'
+}
+
+// Pads digits with leading zeros up to width
+func padNumber(digits string, width int) string {
+	if len(digits) >= width {
+		return digits
+	}
+	return strings.Repeat("0", width-len(digits)) + digits
+}
+
+// Returns the integers going from from to to, by step. The next value is
+// only computed while it stays within to, so the ends can be the int limits.
+func sequence(from, to, step int) []int {
+	values := []int{from}
+	if from <= to {
+		for n := from; uint(to-n) >= uint(step); {
+			n += step
+			values = append(values, n)
+		}
+	} else {
+		for n := from; uint(n-to) >= uint(step); {
+			n -= step
+			values = append(values, n)
+		}
+	}
+	return values
+}
+
+// Joins the units of an expanded word back into the parts of a word
+func joinBraceUnits(units []parser.WordPart) parser.Word {
+	word := parser.Word{}
+	for _, unit := range units {
+		if last := len(word) - 1; last >= 0 && isBraceText(unit) && isBraceText(word[last]) {
+			word[last].Value += unit.Value
+			continue
+		}
+		word = append(word, unit)
+	}
+	return word
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kiasaki/ush/parser"
+)
+
+func TestExpandBraces(t *testing.T) {
+	tests := []struct {
+		word string
+		want []string
+	}{
+		{"a", []string{"a"}},
+		{"a{b,c}d", []string{"abd", "acd"}},
+		{"{a,b}{1,2}", []string{"a1", "a2", "b1", "b2"}},
+		{"{a,{b,c}}x", []string{"ax", "bx", "cx"}},
+		{"x{,y}", []string{"x", "xy"}},
+		{"{1..3}", []string{"1", "2", "3"}},
+		{"{3..1}", []string{"3", "2", "1"}},
+		{"{-1..1}", []string{"-1", "0", "1"}},
+		{"{1..10..3}", []string{"1", "4", "7", "10"}},
+		{"{10..1..-3}", []string{"10", "7", "4", "1"}},
+		{"{01..3}", []string{"01", "02", "03"}},
+		{"{-05..3..2}", []string{"-05", "-03", "-01", "001", "003"}},
+		{"{a..e..2}", []string{"a", "c", "e"}},
+		{"{C..A}", []string{"C", "B", "A"}},
+		{"{9223372036854775806..9223372036854775807}", []string{"9223372036854775806", "9223372036854775807"}},
+		{"{-9223372036854775807..-9223372036854775808}", []string{"-9223372036854775807", "-9223372036854775808"}},
+		{"{5..5}", []string{"5"}},
+		{"{a}", []string{"{a}"}},
+		{"{}", []string{"{}"}},
+		{"{a,b", []string{"{a,b"}},
+		{"a,b}", []string{"a,b}"}},
+		{"{1..a}", []string{"{1..a}"}},
+		{"'{a,b}'", []string{"{a,b}"}},
+		{`\{a,b}`, []string{"{a,b}"}},
+		{`{a,"b c"}`, []string{"a", "b c"}},
+		{"${x}{a,b}", []string{"${x}a", "${x}b"}},
+		{"${x,y}", []string{"${x,y}"}},
+	}
+	for _, test := range tests {
+		tokens, err := parser.Parse(test.word)
+		if err != nil || len(tokens) != 1 {
+			t.Fatalf("Parse(%q) = %v, %v", test.word, tokens, err)
+		}
+		got := []string{}
+		for _, word := range expandBraces(tokens[0].Word) {
+			got = append(got, word.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("expandBraces(%q) = %q, want %q", test.word, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+
+	"github.com/kiasaki/ush/parser"
+)
+
+// Runs the body following the first condition of an `if` to succeed
+func (s *State) executeIf(clause *parser.IfClause) int {
+	for i, condition := range clause.Conditions {
+		if s.Execute(condition) == 0 {
+			return s.Execute(clause.Bodies[i])
+		}
+	}
+	if clause.Else != nil {
+		return s.Execute(clause.Else)
+	}
+	return 0
+}
+
+// Runs a `while` or `until` loop, returning the status of the last command of
+// its body to run
+func (s *State) executeWhile(loop *parser.WhileLoop) int {
+	s.loops++
+	defer func() { s.loops-- }()
+
+	status := 0
+	for {
+		condition := s.Execute(loop.Condition)
+		if s.loopDone(condition) {
+			break
+		}
+		if (condition == 0) == loop.Until {
+			break
+		}
+		status = s.Execute(loop.Body)
+		if s.loopDone(status) {
+			break
+		}
+	}
+	return status
+}
+
+// Runs a `for` loop, returning the status of the last command of its body to
+// run
+func (s *State) executeFor(loop *parser.ForLoop) int {
+	values := []string{}
+	if loop.Words == nil {
+		values = s.getArray("@")
+	}
+	for _, word := range loop.Words {
+		args, err := s.expandWord(word)
+		if err != nil {
+			return s.reportExpansionError(err)
+		}
+		values = append(values, args...)
+	}
+
+	s.loops++
+	defer func() { s.loops-- }()
+
+	status := 0
+	for _, value := range values {
+		if err := s.setVar(loop.Name, value); err != nil {
+			return s.ReportCommandError("%v", err)
+		}
+		status = s.Execute(loop.Body)
+		if s.loopDone(status) {
+			break
+		}
+	}
+	return status
+}
+
+// Returns true when `break`, `continue`, `return` or `exit` is leaving the
+// lists being run
+func (s *State) leaving() bool {
+	return s.breaking > 0 || s.continuing > 0 || s.returning || s.exiting
+}
+
+// Tells if a loop has to stop after running its condition or body, because
+// of `break`, `return`, `exit`, `continue` for an enclosing loop, or of a command
+// being interrupted with ctrl-c
+func (s *State) loopDone(status int) bool {
+	if s.returning || s.exiting {
+		return true
+	}
+	if s.breaking > 0 {
+		s.breaking--
+		return true
+	}
+	if s.continuing > 0 {
+		s.continuing--
+		return s.continuing > 0
+	}
+	return status == 128+int(syscall.SIGINT)
+}
+
+func (s *State) BuiltinBreak(args []string) int {
+	n, err := s.loopCount(args)
+	if err != nil {
+		return s.ReportCommandError("%v", err)
+	}
+	s.breaking = n
+	return 0
+}
+
+func (s *State) BuiltinContinue(args []string) int {
+	n, err := s.loopCount(args)
+	if err != nil {
+		return s.ReportCommandError("%v", err)
+	}
+	s.continuing = n
+	return 0
+}
+
+// Returns the number of loops `break` or `continue` applies to, 1 by default
+// and at most the number of loops being run
+func (s *State) loopCount(args []string) (int, error) {
+	if len(args) > 2 {
+		return 0, fmt.Errorf("%s needs at most 1 argument, got [%s]", args[0], parser.Format(args...))
+	}
+	if s.loops == 0 {
+		return 0, fmt.Errorf("%s: only meaningful in a `for', `while', or `until' loop", args[0])
+	}
+	n := 1
+	if len(args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+			return 0, fmt.Errorf("%s: %s: loop count out of range", args[0], args[1])
+		}
+	}
+	if n > s.loops {
+		n = s.loops
+	}
+	return n, nil
+}
+
+// Runs the body of the first item of a `case` with a pattern matching its
+// word, returning 0 when none matches
+func (s *State) executeCase(clause *parser.CaseClause) int {
+	word, err := s.expandText(clause.Word)
+	if err != nil {
+		return s.reportExpansionError(err)
+	}
+	for _, item := range clause.Items {
+		for _, p := range item.Patterns {
+			pattern, err := s.expandPatternWord(p)
+			if err != nil {
+				return s.reportExpansionError(err)
+			}
+			if !matchPattern(pattern, word, s.matchOptions()) {
+				continue
+			}
+			if len(item.Body.Pipelines) == 0 {
+				return 0
+			}
+			return s.Execute(item.Body)
+		}
+	}
+	return 0
+}
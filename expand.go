@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/kiasaki/ush/parser"
+)
+
+// Expands the assignments, arguments and redirection targets of a command
+// into a new command, leaving the parsed one untouched. Compound commands get expanded
+// as they run, and so do the assignments of commands made only of assignments,
+// which can refer to the previous ones.
+func (s *State) expandCommand(command *parser.Command) (*parser.Command, error) {
+	expanded := &parser.Command{Args: make([]string, 0), Compound: command.Compound}
+	s.substitutionStatus = 0
+	for _, a := range command.Assignments {
+		assignment := *a
+		if len(command.Words) == 0 && command.Compound == nil {
+			expanded.Assignments = append(expanded.Assignments, &assignment)
+			continue
+		}
+		value, err := s.expandAssignment(assignment.ValueWord)
+		if err != nil {
+			return nil, err
+		}
+		assignment.Value, assignment.ValueWord = value, nil
+		expanded.Assignments = append(expanded.Assignments, &assignment)
+	}
+
+	declaration := len(command.Words) > 0 && declarationBuiltins[command.Words[0].String()]
+	for i, word := range command.Words {
+		if i > 0 && declaration {
+			if arg, ok, err := s.expandDeclaration(word); err != nil {
+				return nil, err
+			} else if ok {
+				expanded.Args = append(expanded.Args, arg)
+				continue
+			}
+		}
+		args, err := s.expandWord(word)
+		if err != nil {
+			return nil, err
+		}
+		expanded.Args = append(expanded.Args, args...)
+	}
+
+	for _, r := range command.Redirects {
+		redirect := *r
+		switch redirect.Op {
+		case "<<", "<<-":
+			if !redirect.Quoted {
+				body, err := parser.ParseHereDoc(redirect.Body)
+				if err != nil {
+					return nil, err
+				}
+				if redirect.Body, err = s.expandText(body); err != nil {
+					return nil, err
+				}
+			}
+		case "<<<":
+			target, err := s.expandText(redirect.TargetWord)
+			if err != nil {
+				return nil, err
+			}
+			redirect.Target = target
+		default:
+			targets, err := s.expandWord(redirect.TargetWord)
+			if err != nil {
+				return nil, err
+			}
+			if len(targets) != 1 {
+				return nil, fmt.Errorf("ambiguous redirect [%s]", redirect.Target)
+			}
+			redirect.Target = targets[0]
+		}
+		expanded.Redirects = append(expanded.Redirects, &redirect)
+	}
+
+	return expanded, nil
+}
+
+// Builtins whose `name=value` arguments are expanded like assignments
+var declarationBuiltins = map[string]bool{"export": true, "readonly": true, "local": true}
+
+// Expands an argument of export, readonly or local like an assignment when it
+// is one, as in `export PATH=~/bin:$PATH`, with ~ expanded after the `=` and
+// each `:` and the value kept as a single argument. ok is false for other
+// arguments.
+func (s *State) expandDeclaration(word parser.Word) (arg string, ok bool, err error) {
+	if len(word) == 0 || word[0].Quoting != parser.Unquoted || word[0].Substitution || word[0].Arithmetic {
+		return "", false, nil
+	}
+	name, value, hasValue := splitAssignment(word[0].Value)
+	if !hasValue || !isName(name) {
+		return "", false, nil
+	}
+	valueWord := word[1:]
+	if value != "" {
+		valueWord = append(parser.Word{{Value: value}}, word[1:]...)
+	}
+	if value, err = s.expandAssignment(valueWord); err != nil {
+		return "", false, err
+	}
+	return name + "=" + value, true, nil
+}
+
+// field is an argument being expanded, along with its text as a glob pattern
+// in which quoted characters are escaped
+type field struct {
+	text    bytes.Buffer
+	pattern bytes.Buffer
+	started bool // true once something, even empty quotes, started the field
+}
+
+func (f *field) write(text string) {
+	f.text.WriteString(text)
+	f.pattern.WriteString(text)
+	f.started = true
+}
+
+// Adds quoted text to the field, taken literally when globbing
+func (f *field) writeQuoted(text string) {
+	f.text.WriteString(text)
+	f.pattern.WriteString(escapeGlob(text))
+	f.started = true
+}
+
+// Expands braces, ~, variables, command substitutions, arithmetic
+// expressions and globs in a word, returning the resulting arguments. Brace
+// expansion comes first, the words it results in being expanded in turn.
+// Expansions only happen where the word's quoting allows them: single-quoted
+// parts are taken literally, double-quoted ones don't get braces, ~ and globs
+// expanded. The results of expansions outside of quotes are split into
+// several arguments on whitespace.
+func (s *State) expandWord(word parser.Word) ([]string, error) {
+	args := []string{}
+	for _, w := range expandBraces(word) {
+		fields, err := s.expandFields(w)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, fields...)
+	}
+	return args, nil
+}
+
+// Expands a word once its braces are expanded
+func (s *State) expandFields(word parser.Word) ([]string, error) {
+	fields := []*field{}
+	f := &field{}
+	endField := func() {
+		if f.started {
+			fields = append(fields, f)
+			f = &field{}
+		}
+	}
+
+	// Adds the value of an unquoted expansion, split into fields
+	split := func(value string) {
+		words := strings.FieldsFunc(value, isFieldSeparator)
+		if len(value) > 0 && isFieldSeparator(rune(value[0])) {
+			endField()
+		}
+		for j, w := range words {
+			if j > 0 {
+				endField()
+			}
+			f.write(w)
+		}
+		if len(words) > 0 && isFieldSeparator(rune(value[len(value)-1])) {
+			endField()
+		}
+	}
+
+	for i, part := range word {
+		value := part.Value
+		var err error
+		if part.Substitution || part.Arithmetic {
+			value, err = s.substitute(part)
+		} else if part.Quoting == parser.DoubleQuoted {
+			// "$@" is an argument per positional parameter, no argument at
+			// all without any
+			positional := false
+			for {
+				before, after, ok := splitAtPositional(value)
+				if !ok {
+					break
+				}
+				if before, err = s.expandVariables(before); err != nil {
+					return nil, err
+				}
+				if before != "" {
+					f.writeQuoted(before)
+				}
+				for j, arg := range s.Positional {
+					if j > 0 {
+						endField()
+					}
+					f.writeQuoted(arg)
+				}
+				value, positional = after, true
+			}
+			if value, err = s.expandVariables(value); err == nil && positional && value == "" {
+				continue
+			}
+		} else if part.Quoting == parser.Unquoted {
+			if i == 0 {
+				if dir, rest, ok := s.expandTilde(value, "/"); ok && (rest != "" || len(word) == 1) {
+					f.writeQuoted(dir)
+					value = rest
+				}
+			}
+			// Quoted parts of `${NAME:-word}` words aren't split
+			parts, err := s.expandVariableParts(value)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range parts {
+				if p.Quoting != parser.Unquoted {
+					f.writeQuoted(p.Value)
+				} else {
+					split(p.Value)
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.Quoting != parser.Unquoted {
+			f.writeQuoted(value)
+			continue
+		}
+		split(value)
+	}
+	endField()
+
+	args := []string{}
+	for _, f := range fields {
+		pattern := f.pattern.String()
+		if !hasGlob(pattern, s.ShellOptions["extglob"]) {
+			args = append(args, f.text.String())
+			continue
+		}
+		matches := s.glob(pattern)
+		if len(matches) > 0 {
+			args = append(args, matches...)
+			continue
+		}
+
+		// Globs matching nothing are left as they are, unless nullglob
+		// removes them or failglob makes them an error
+		if s.ShellOptions["failglob"] {
+			return nil, fmt.Errorf("no match: %s", f.text.String())
+		}
+		if !s.ShellOptions["nullglob"] {
+			args = append(args, f.text.String())
+		}
+	}
+	return args, nil
+}
+
+// Expands ~, variables, command substitutions and arithmetic expressions in
+// a word into a single string, without splitting it or expanding globs
+func (s *State) expandText(word parser.Word) (string, error) {
+	return s.expandString(word, false)
+}
+
+// Expands the value of an assignment like expandText, ~ being expanded after
+// the `=` and after each unquoted `:` too, as in `PATH=~/bin:~/go/bin`
+func (s *State) expandAssignment(word parser.Word) (string, error) {
+	return s.expandString(word, true)
+}
+
+func (s *State) expandString(word parser.Word, assignment bool) (string, error) {
+	var buf bytes.Buffer
+	for i, part := range word {
+		if part.Substitution || part.Arithmetic {
+			value, err := s.substitute(part)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString(value)
+		} else if part.Quoting == parser.SingleQuoted {
+			buf.WriteString(part.Value)
+		} else if part.Quoting == parser.DoubleQuoted {
+			value, err := s.expandVariables(part.Value)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString(value)
+		} else {
+			stops, texts := "/", []string{part.Value}
+			if assignment {
+				stops, texts = "/:", splitAtColons(part.Value)
+			}
+			for j, text := range texts {
+				if j > 0 {
+					buf.WriteByte(':')
+				}
+				if i == 0 || j > 0 {
+					// A tilde prefix ending the part could go on in the next one
+					continued := j == len(texts)-1 && i < len(word)-1
+					if dir, rest, ok := s.expandTilde(text, stops); ok && (rest != "" || !continued) {
+						buf.WriteString(dir)
+						text = rest
+					}
+				}
+				value, err := s.expandVariables(text)
+				if err != nil {
+					return "", err
+				}
+				buf.WriteString(value)
+			}
+		}
+	}
+	return buf.String(), nil
+}
+
+// Splits unquoted text at its colons, apart from those within `${...}`
+func splitAtColons(text string) []string {
+	texts := []string{}
+	start := 0
+	for i := 0; i < len(text); i++ {
+		if strings.HasPrefix(text[i:], "${") {
+			if end, err := parser.ParameterEnd(text[i+2:]); err == nil {
+				i += 1 + end
+			}
+		} else if text[i] == ':' {
+			texts = append(texts, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(texts, text[start:])
+}
+
+func isFieldSeparator(c rune) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+// Returns the output of a command substitution part of a word, or the value
+// of an arithmetic expansion one
+func (s *State) substitute(part parser.WordPart) (string, error) {
+	if part.Arithmetic {
+		return s.expandArithmetic(part.Value)
+	}
+	output, status := s.substituteCommand(part.Value)
+	s.substitutionStatus = status
+	return output, nil
+}
+
+// Runs a command in a subshell, returning what it wrote to stdout
+// with trailing newlines removed, and its exit status
+func (s *State) substituteCommand(command string) (string, int) {
+	list := s.ParseLine(command)
+	if list == nil {
+		return "", 2 // Syntax error
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", s.ReportCommandError("error creating pipe %v", err)
+	}
+	var output bytes.Buffer
+	read := make(chan bool)
+	go func() {
+		output.ReadFrom(r)
+		r.Close()
+		read <- true
+	}()
+
+	sub := s.subshell()
+	sub.stdout = w
+	status := sub.Execute(list)
+	w.Close()
+	<-read
+
+	return strings.TrimRight(output.String(), "\n"), status
+}
+
+// Expands the tilde prefix text starts with, up to the first slash or other
+// character of stops, returning the directory it stands for and the rest of
+// text: `~` is $HOME, `~+` $PWD, `~-` $OLDPWD and `~user` the home directory
+// of user. ok is false when text doesn't start with a tilde prefix that can
+// be expanded, like the one of an unknown user.
+func (s *State) expandTilde(text, stops string) (dir string, rest string, ok bool) {
+	if !strings.HasPrefix(text, "~") {
+		return "", text, false
+	}
+	end := strings.IndexAny(text, stops)
+	if end == -1 {
+		end = len(text)
+	}
+	switch name := text[1:end]; name {
+	case "":
+		if dir, ok = s.lookupVar("HOME"); !ok {
+			if u, err := user.Current(); err == nil {
+				dir, ok = u.HomeDir, true
+			}
+		}
+	case "+":
+		dir, ok = s.lookupVar("PWD")
+	case "-":
+		dir, ok = s.lookupVar("OLDPWD")
+	default:
+		if u, err := user.Lookup(name); err == nil {
+			dir, ok = u.HomeDir, true
+		}
+	}
+	return dir, text[end:], ok
+}
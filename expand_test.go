@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kiasaki/ush/parser"
+)
+
+func TestExpandFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.go", "b.go"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		input      string
+		positional []string
+		want       []string
+	}{
+		{`"$@"`, nil, []string{}},
+		{`"$@"`, []string{"a b", "c"}, []string{"a b", "c"}},
+		{`x"$@"y`, []string{"a", "b c"}, []string{"xa", "b cy"}},
+		{`x"$@"y`, nil, []string{"xy"}},
+		{`"$@" "$@"`, []string{"a"}, []string{"a", "a"}},
+		{`$@`, []string{"a b", "c"}, []string{"a", "b", "c"}},
+		{`"$*"`, []string{"a b", "c"}, []string{"a b c"}},
+		{`$y`, nil, []string{"1", "2"}},
+		{`"$y"`, nil, []string{" 1  2 "}},
+		{`a$y"b"`, nil, []string{"a", "1", "2", "b"}},
+		{`a$z"b"`, nil, []string{"a1", "2b"}},
+		{`$unset`, nil, []string{}},
+		{`${unset:-"a b"}`, nil, []string{"a b"}},
+		{`${unset:-"a b" c}`, nil, []string{"a b", "c"}},
+		{`${unset:-x"a b"y}`, nil, []string{"xa by"}},
+		{`""`, nil, []string{""}},
+		{`''`, nil, []string{""}},
+		{`""$unset`, nil, []string{""}},
+		{`$unset""`, nil, []string{""}},
+		{`"" ""`, nil, []string{"", ""}},
+		{`*.go`, nil, []string{"a.go", "b.go"}},
+		{`"*".go`, nil, []string{"*.go"}},
+		{`'*.go'`, nil, []string{"*.go"}},
+		{`\*.go`, nil, []string{"*.go"}},
+		{`"$g"`, nil, []string{"*.go"}},
+		{`$g`, nil, []string{"a.go", "b.go"}},
+		{`"a"?.go`, nil, []string{"a?.go"}},
+		{`[ab].go`, nil, []string{"a.go", "b.go"}},
+		{`"["a].go`, nil, []string{"[a].go"}},
+	}
+	for _, test := range tests {
+		s := NewState()
+		s.Cwd = dir
+		s.Positional = test.positional
+		s.setVar("y", " 1  2 ")
+		s.setVar("z", "1 2")
+		s.setVar("g", "*.go")
+
+		tokens, err := parser.Parse(test.input)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", test.input, err)
+		}
+		got := []string{}
+		for _, token := range tokens {
+			fields, err := s.expandWord(token.Word)
+			if err != nil {
+				t.Fatalf("expanding %q failed: %v", test.input, err)
+			}
+			got = append(got, fields...)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("expanding %q with %q = %q, want %q", test.input, test.positional, got, test.want)
+		}
+	}
+}
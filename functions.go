@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kiasaki/ush/parser"
+)
+
+// Functions calling themselves fail past this depth instead of exhausting
+// the shell's memory
+const maxCallDepth = 1000
+
+// Calls a function with the given arguments, args[0] being its name, as its
+// positional parameters. Variables made local to the call are restored
+// afterwards.
+func (s *State) callFunction(fn *parser.FunctionDef, args []string) int {
+	if len(s.locals) >= maxCallDepth {
+		return s.ReportCommandError("%s: maximum function nesting level exceeded (%d)", fn.Name, maxCallDepth)
+	}
+	positional, loops := s.Positional, s.loops
+	s.Positional, s.loops = args[1:], 0
+	s.locals = append(s.locals, map[string]*Variable{})
+	s.calls++
+
+	status := s.Execute(fn.Body)
+
+	s.calls--
+	s.returning = false
+	locals := s.locals[len(s.locals)-1]
+	s.locals = s.locals[:len(s.locals)-1]
+	for name, saved := range locals {
+		if saved != nil {
+			s.Vars[name] = saved
+		} else {
+			delete(s.Vars, name)
+		}
+	}
+	s.Positional, s.loops = positional, loops
+	return status
+}
+
+func (s *State) BuiltinReturn(args []string) int {
+	if len(args) > 2 {
+		return s.ReportCommandError("return needs at most 1 argument, got [%s]", parser.Format(args...))
+	}
+	if s.calls == 0 {
+		return s.ReportCommandError("return: can only `return' from a function or sourced script")
+	}
+	status := s.LastStatus
+	if len(args) == 2 {
+		var err error
+		if status, err = strconv.Atoi(args[1]); err != nil {
+			s.ReportCommandError("return: %s: numeric argument required", args[1])
+			status = 2
+		}
+	}
+	s.returning = true
+	return status & 0xff
+}
+
+func (s *State) BuiltinShift(args []string) int {
+	if len(args) > 2 {
+		return s.ReportCommandError("shift needs at most 1 argument, got [%s]", parser.Format(args...))
+	}
+	n := 1
+	if len(args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 0 {
+			return s.ReportCommandError("shift: %s: shift count out of range", args[1])
+		}
+	}
+	if n > len(s.Positional) {
+		return 1
+	}
+	s.Positional = s.Positional[n:]
+	return 0
+}
+
+// Handles `local name=value` and `local name`, the latter leaving the
+// variable unset until assigned
+func (s *State) BuiltinLocal(args []string) int {
+	if len(s.locals) == 0 {
+		return s.ReportCommandError("local: can only be used in a function")
+	}
+	locals := s.locals[len(s.locals)-1]
+	status := 0
+	for _, arg := range args[1:] {
+		name, value, hasValue := splitAssignment(arg)
+		if !isName(name) {
+			status = s.ReportCommandError("local: `%s': not a valid identifier", arg)
+			continue
+		}
+		if v, ok := s.Vars[name]; ok && v.ReadOnly {
+			status = s.ReportCommandError("local: %s: readonly variable", name)
+			continue
+		}
+		shadowed, ok := locals[name]
+		if !ok {
+			shadowed = s.Vars[name]
+			locals[name] = shadowed
+		}
+		// The local variable replaces the shadowed one until the function
+		// returns, staying exported if it was
+		local := &Variable{Value: value, Unset: !hasValue}
+		if shadowed != nil {
+			local.Exported = shadowed.Exported
+		}
+		s.Vars[name] = local
+	}
+	return status
+}
+
+// Splits a `name=value` argument, returning false when it has no `=`
+func splitAssignment(arg string) (name, value string, ok bool) {
+	if i := strings.IndexByte(arg, '='); i != -1 {
+		return arg[:i], arg[i+1:], true
+	}
+	return arg, "", false
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Returns true if pattern has unescaped characters making it a glob, or
+// extended groups when they are recognized
+func hasGlob(pattern string, extended bool) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		case '+', '@', '!':
+			if extended && i+1 < len(pattern) && pattern[i+1] == '(' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Removes the backslashes escaping characters of a pattern
+func unescapeGlob(pattern string) string {
+	if !strings.Contains(pattern, "\\") {
+		return pattern
+	}
+	var buf strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		buf.WriteByte(pattern[i])
+	}
+	return buf.String()
+}
+
+// Splits a pattern into the parts between its slashes, escaped slashes
+// included
+func splitGlob(pattern string) []string {
+	segments := []string{}
+	start := 0
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' {
+			i++
+		} else if pattern[i] == '/' {
+			segments = append(segments, pattern[start:i])
+			start = i + 1
+		}
+	}
+	return append(segments, pattern[start:])
+}
+
+// globber finds the paths matching a glob pattern
+type globber struct {
+	s       *State
+	options matchOptions
+	dotGlob bool // names starting with a dot are matched by any pattern
+	matches []string
+}
+
+// Returns the paths matching a glob pattern, sorted. Relative patterns are
+// matched from the shell's current directory. `**` as a whole path segment
+// matches any number of directories, and names starting with a dot are only
+// matched by patterns starting with one, unless dotglob is set.
+func (s *State) glob(pattern string) []string {
+	g := &globber{s: s, options: s.matchOptions(), dotGlob: s.ShellOptions["dotglob"]}
+	g.options.foldCase = s.ShellOptions["nocaseglob"]
+	g.segments("", splitGlob(pattern))
+	sort.Strings(g.matches)
+
+	// `**` can reach the same path more than once
+	unique := g.matches[:0]
+	for i, match := range g.matches {
+		if i == 0 || match != g.matches[i-1] {
+			unique = append(unique, match)
+		}
+	}
+	return unique
+}
+
+// Adds the paths matching the remaining segments of a pattern, prefix being
+// the path matched so far, either empty or ending with a slash
+func (g *globber) segments(prefix string, segments []string) {
+	segment, rest := segments[0], segments[1:]
+	last := len(rest) == 0
+
+	if !hasGlob(segment, g.options.extended) {
+		path := prefix + unescapeGlob(segment)
+		if last {
+			if _, err := os.Lstat(g.s.absPath(path)); err == nil {
+				g.matches = append(g.matches, path)
+			}
+		} else if g.s.isDir(path) {
+			g.segments(path+"/", rest)
+		}
+		return
+	}
+
+	if segment == "**" {
+		if last {
+			// The directory itself is matched too, as `src/` for `src/**`
+			if prefix != "" {
+				g.matches = append(g.matches, prefix)
+			}
+			g.tree(prefix)
+			return
+		}
+		g.segments(prefix, rest)
+		for _, info := range g.s.readDir(prefix) {
+			if info.IsDir() && g.visible(info.Name(), "") {
+				g.segments(prefix+info.Name()+"/", segments)
+			}
+		}
+		return
+	}
+
+	for _, info := range g.s.readDir(prefix) {
+		name := info.Name()
+		if !g.visible(name, segment) || !matchPattern(segment, name, g.options) {
+			continue
+		}
+		if last {
+			g.matches = append(g.matches, prefix+name)
+		} else if g.s.isDir(prefix + name) {
+			g.segments(prefix+name+"/", rest)
+		}
+	}
+}
+
+// Adds every path below a directory, as matched by a trailing `**`, without
+// following symbolic links
+func (g *globber) tree(prefix string) {
+	for _, info := range g.s.readDir(prefix) {
+		if !g.visible(info.Name(), "") {
+			continue
+		}
+		g.matches = append(g.matches, prefix+info.Name())
+		if info.IsDir() {
+			g.tree(prefix + info.Name() + "/")
+		}
+	}
+}
+
+// Returns true if a name can be matched by a pattern segment, names starting
+// with a dot needing the segment to start with one too unless dotglob is set
+func (g *globber) visible(name, segment string) bool {
+	return name[0] != '.' || g.dotGlob || strings.HasPrefix(unescapeGlob(segment), ".")
+}
+
+// Lists a directory's entries, none if it can't be read
+func (s *State) readDir(path string) []os.FileInfo {
+	infos, err := ioutil.ReadDir(s.absPath(path))
+	if err != nil {
+		return nil
+	}
+	return infos
+}
+
+func (s *State) isDir(path string) bool {
+	info, err := os.Stat(s.absPath(path))
+	return err == nil && info.IsDir()
+}
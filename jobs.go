@@ -0,0 +1,555 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Process is an external command started by a job
+type Process struct {
+	Pid     int
+	Stopped bool
+	Done    bool
+	Status  int
+}
+
+// Job is a pipeline, or a list of pipelines ran in the background, along with
+// the processes it started
+type Job struct {
+	Id        int
+	Command   string
+	Processes []*Process
+	Pgid      int  // process group of the job's processes, 0 without job control
+	Done      bool // true once all of the job's commands finished
+	Status    int  // exit status of the job once done
+
+	notified string // last state reported to the user
+}
+
+// Returns true if any of the job's processes got stopped
+func (j *Job) Stopped() bool {
+	for _, p := range j.Processes {
+		if p.Stopped && !p.Done {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Job) State() string {
+	if j.Done {
+		if j.Status != 0 {
+			return fmt.Sprintf("Exit %d", j.Status)
+		}
+		return "Done"
+	}
+	if j.Stopped() {
+		return "Stopped"
+	}
+	return "Running"
+}
+
+// Pid returns the process id of the last process the job started, 0 if it
+// didn't start any
+func (j *Job) Pid() int {
+	if len(j.Processes) == 0 {
+		return 0
+	}
+	return j.Processes[len(j.Processes)-1].Pid
+}
+
+// Sends a signal to all of the job's running processes, through its process
+// group when it has one
+func (j *Job) signal(sig syscall.Signal) {
+	if j.Pgid != 0 {
+		syscall.Kill(-j.Pgid, sig)
+		return
+	}
+	for _, p := range j.Processes {
+		if !p.Done {
+			syscall.Kill(p.Pid, sig)
+		}
+	}
+}
+
+// JobTable holds the jobs ran in the background or stopped. It's shared
+// between the shell and the copies of its state running pipeline stages or
+// background lists, its lock guards every job and process.
+type JobTable struct {
+	mu         sync.Mutex
+	changed    *sync.Cond // broadcasted every time a job or process changes
+	jobs       []*Job
+	foreground *Job // job the shell is waiting on, if any
+	control    bool // true when jobs get their own process group and the terminal
+}
+
+func NewJobTable() *JobTable {
+	t := &JobTable{jobs: []*Job{}}
+	t.changed = sync.NewCond(&t.mu)
+	return t
+}
+
+// Adds a job to the table, the caller must be holding the table's lock
+func (t *JobTable) add(job *Job) {
+	job.Id = 1
+	if len(t.jobs) > 0 {
+		job.Id = t.jobs[len(t.jobs)-1].Id + 1
+	}
+	t.jobs = append(t.jobs, job)
+}
+
+// Removes a job from the table, the caller must be holding the table's lock
+func (t *JobTable) remove(job *Job) {
+	for i, j := range t.jobs {
+		if j == job {
+			t.jobs = append(t.jobs[:i], t.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Makes job the current one, the one `fg` and `bg` default to. The caller
+// must be holding the table's lock.
+func (t *JobTable) makeCurrent(job *Job) {
+	t.remove(job)
+	t.jobs = append(t.jobs, job)
+}
+
+// Marks a job as done, the caller must be holding the table's lock
+func (t *JobTable) finish(job *Job, status int) {
+	job.Done = true
+	job.Status = status
+	t.changed.Broadcast()
+}
+
+// Waits for a job started in the foreground to either finish or get stopped,
+// returning its status. Finished jobs are removed from the table. The caller
+// must be holding the table's lock.
+func (t *JobTable) waitForeground(job *Job) int {
+	for !job.Done && !job.Stopped() {
+		t.changed.Wait()
+	}
+	if job.Done {
+		t.remove(job)
+		return job.Status
+	}
+	return 128 + int(syscall.SIGTSTP)
+}
+
+// Finds a job from a job spec like %1, %+, %- or %name. Specs without a
+// leading % are taken as a job number or the process id of one of its
+// processes. The caller must be holding the table's lock.
+func (t *JobTable) find(spec string) (*Job, error) {
+	if len(t.jobs) == 0 {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	if spec == "" || spec == "%" || spec == "%%" || spec == "%+" {
+		return t.jobs[len(t.jobs)-1], nil
+	}
+	if spec == "%-" {
+		if len(t.jobs) < 2 {
+			return nil, fmt.Errorf("%s: no such job", spec)
+		}
+		return t.jobs[len(t.jobs)-2], nil
+	}
+
+	if strings.HasPrefix(spec, "%") {
+		if id, err := strconv.Atoi(spec[1:]); err == nil {
+			for _, job := range t.jobs {
+				if job.Id == id {
+					return job, nil
+				}
+			}
+		} else {
+			for i := len(t.jobs) - 1; i >= 0; i-- {
+				if strings.HasPrefix(t.jobs[i].Command, spec[1:]) {
+					return t.jobs[i], nil
+				}
+			}
+		}
+	} else if id, err := strconv.Atoi(spec); err == nil {
+		for _, job := range t.jobs {
+			if job.Id == id {
+				return job, nil
+			}
+			for _, p := range job.Processes {
+				if p.Pid == id {
+					return job, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s: no such job", spec)
+}
+
+// Returns the marker shown next to a job's id, + for the current job and -
+// for the previous one. The caller must be holding the table's lock.
+func (t *JobTable) marker(job *Job) string {
+	if len(t.jobs) > 0 && t.jobs[len(t.jobs)-1] == job {
+		return "+"
+	}
+	if len(t.jobs) > 1 && t.jobs[len(t.jobs)-2] == job {
+		return "-"
+	}
+	return " "
+}
+
+// Prints a line like `[1]+  Stopped    vim` for a job. The caller must be
+// holding the table's lock.
+func (t *JobTable) printJob(w io.Writer, job *Job, pid bool) {
+	command := job.Command
+	if !job.Done && !job.Stopped() {
+		command += " &"
+	}
+	if pid {
+		fmt.Fprintf(w, "[%d]%s %d %-10s %s\n", job.Id, t.marker(job), job.Pid(), job.State(), command)
+	} else {
+		fmt.Fprintf(w, "[%d]%s  %-10s %s\n", job.Id, t.marker(job), job.State(), command)
+	}
+}
+
+// Notify prints the jobs that changed state since last notified, then removes
+// finished jobs from the table
+func (t *JobTable) Notify(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, job := range t.jobs {
+		if state := job.State(); state != job.notified {
+			t.printJob(w, job, false)
+			job.notified = state
+		}
+	}
+	t.removeDone()
+}
+
+// Prune removes finished jobs from the table without notifying about them, as
+// non-interactive shells do
+func (t *JobTable) Prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeDone()
+}
+
+// Removes finished jobs from the table. The caller must be holding the
+// table's lock.
+func (t *JobTable) removeDone() {
+	for i := 0; i < len(t.jobs); i++ {
+		if t.jobs[i].Done {
+			t.remove(t.jobs[i])
+			i--
+		}
+	}
+}
+
+// Hangup sends SIGHUP to stopped jobs so they don't linger after the shell
+// exits, then wakes them up so they can handle it
+func (t *JobTable) Hangup() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, job := range t.jobs {
+		if job.Stopped() {
+			job.signal(syscall.SIGHUP)
+			job.signal(syscall.SIGCONT)
+		}
+	}
+}
+
+// Continues a stopped job. The caller must be holding the table's lock.
+func (t *JobTable) continueJob(job *Job) {
+	for _, p := range job.Processes {
+		p.Stopped = false
+	}
+	job.signal(syscall.SIGCONT)
+	job.notified = "Running"
+}
+
+// Returns the attributes to start one of job's processes with. With job
+// control, the first process starts a new process group that the others join,
+// and the foreground job's group is given the terminal.
+func (t *JobTable) processAttr(job *Job) *syscall.SysProcAttr {
+	if !t.control {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// The group goes away along with its last process
+	if job.Pgid != 0 && !job.running() {
+		job.Pgid = 0
+	}
+	return &syscall.SysProcAttr{
+		Setpgid:    true,
+		Pgid:       job.Pgid,
+		Foreground: job == t.foreground,
+		Ctty:       int(os.Stdin.Fd()),
+	}
+}
+
+// Returns the process id of the last job started in the background, as $!
+func (s *State) lastBackgroundPid() (string, bool) {
+	if s.lastBackground == nil {
+		return "", false
+	}
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	pid := s.lastBackground.Pid()
+	if pid == 0 {
+		return "", false
+	}
+	return strconv.Itoa(pid), true
+}
+
+// Adds a process started with the given attributes to a job
+func (t *JobTable) addProcess(job *Job, pid int, attr *syscall.SysProcAttr) *Process {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if attr != nil && attr.Setpgid && job.Pgid == 0 {
+		job.Pgid = pid
+	}
+	proc := &Process{Pid: pid}
+	job.Processes = append(job.Processes, proc)
+	return proc
+}
+
+// Returns true if any of the job's processes didn't exit yet
+func (j *Job) running() bool {
+	for _, p := range j.Processes {
+		if !p.Done {
+			return true
+		}
+	}
+	return false
+}
+
+// SignalForeground sends a signal to the job the shell is waiting on,
+// returning false when there is none
+func (t *JobTable) SignalForeground(sig syscall.Signal) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.foreground == nil || !t.foreground.running() {
+		return false
+	}
+	t.foreground.signal(sig)
+	return true
+}
+
+// Gives the terminal to the job's process group, or back to the shell for a
+// nil job. Does nothing without job control. The caller must be holding the
+// table's lock.
+func (t *JobTable) setTerminalJob(job *Job) {
+	if !t.control {
+		return
+	}
+	pgid := syscall.Getpgrp()
+	if job != nil {
+		if job.Pgid == 0 {
+			return
+		}
+		pgid = job.Pgid
+	}
+
+	// The shell gets SIGTTOU when taking the terminal back from the
+	// foreground, as it's not part of the foreground group then
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	setTerminalPgrp(pgid)
+}
+
+// Returns the process group owning the terminal on stdin
+func terminalPgrp() (int, error) {
+	var pgid int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdin.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgid)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(pgid), nil
+}
+
+// Makes the process group own the terminal on stdin
+func setTerminalPgrp(pgid int) error {
+	id := int32(pgid)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdin.Fd(), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&id)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Waits for a started command to exit, keeping track of its process getting
+// stopped and continued
+func (s *State) waitProcess(cmd *exec.Cmd, proc *Process) int {
+	for {
+		var ws syscall.WaitStatus
+		_, err := syscall.Wait4(proc.Pid, &ws, syscall.WUNTRACED|syscall.WCONTINUED, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		s.jobs.mu.Lock()
+		if err != nil {
+			proc.Done = true
+			proc.Status = s.ReportCommandError("error waiting for [%d] %v", proc.Pid, err)
+		} else if ws.Stopped() {
+			proc.Stopped = true
+		} else if ws.Continued() {
+			proc.Stopped = false
+		} else if ws.Signaled() {
+			proc.Done = true
+			proc.Status = 128 + int(ws.Signal())
+		} else {
+			proc.Done = true
+			proc.Status = ws.ExitStatus()
+		}
+		s.jobs.changed.Broadcast()
+		s.jobs.mu.Unlock()
+
+		if proc.Done {
+			// The process is already reaped, this only waits for the
+			// goroutines copying its input and output
+			cmd.Wait()
+			return proc.Status
+		}
+	}
+}
+
+func (s *State) BuiltinJobs(args []string) int {
+	pids, pidsOnly := false, false
+	specs := []string{}
+	for _, arg := range args[1:] {
+		if arg == "-l" {
+			pids = true
+		} else if arg == "-p" {
+			pidsOnly = true
+		} else {
+			specs = append(specs, arg)
+		}
+	}
+
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+
+	jobs := s.jobs.jobs
+	if len(specs) > 0 {
+		jobs = []*Job{}
+		for _, spec := range specs {
+			job, err := s.jobs.find(spec)
+			if err != nil {
+				return s.ReportCommandError("jobs: %v", err)
+			}
+			jobs = append(jobs, job)
+		}
+	}
+
+	for _, job := range jobs {
+		if pidsOnly {
+			fmt.Fprintf(s.stdout, "%d\n", job.Pid())
+		} else {
+			s.jobs.printJob(s.stdout, job, pids)
+			job.notified = job.State()
+		}
+	}
+	return 0
+}
+
+func (s *State) BuiltinFg(args []string) int {
+	if len(args) > 2 {
+		return s.ReportCommandError("fg needs at most 1 argument, got [%s]", strings.Join(args, " "))
+	}
+	spec := ""
+	if len(args) == 2 {
+		spec = args[1]
+	}
+
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+
+	job, err := s.jobs.find(spec)
+	if err != nil {
+		return s.ReportCommandError("fg: %v", err)
+	}
+	fmt.Fprintln(s.stderr, job.Command)
+	s.jobs.makeCurrent(job)
+	s.jobs.foreground = job
+	s.jobs.setTerminalJob(job)
+	s.jobs.continueJob(job)
+	status := s.jobs.waitForeground(job)
+	s.jobs.foreground = nil
+	s.jobs.setTerminalJob(nil)
+	return status
+}
+
+func (s *State) BuiltinBg(args []string) int {
+	specs := args[1:]
+	if len(specs) == 0 {
+		specs = []string{""}
+	}
+
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+
+	status := 0
+	for _, spec := range specs {
+		job, err := s.jobs.find(spec)
+		if err != nil {
+			status = s.ReportCommandError("bg: %v", err)
+			continue
+		}
+		if job.Done || !job.Stopped() {
+			status = s.ReportCommandError("bg: job %d already in background", job.Id)
+			continue
+		}
+		s.jobs.makeCurrent(job)
+		s.jobs.continueJob(job)
+		fmt.Fprintf(s.stderr, "[%d]%s %s &\n", job.Id, s.jobs.marker(job), job.Command)
+	}
+	return status
+}
+
+func (s *State) BuiltinWait(args []string) int {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+
+	if len(args) == 1 {
+		for _, job := range append([]*Job{}, s.jobs.jobs...) {
+			for !job.Done && !job.Stopped() {
+				s.jobs.changed.Wait()
+			}
+			if job.Done {
+				s.jobs.remove(job)
+			}
+		}
+		return 0
+	}
+
+	status := 0
+	for _, spec := range args[1:] {
+		job, err := s.jobs.find(spec)
+		if last := s.lastBackground; err != nil && last != nil && spec == strconv.Itoa(last.Pid()) {
+			// $! can be waited for after its job was pruned from the table
+			job, err = last, nil
+		}
+		if err != nil {
+			status = 127
+			s.ReportCommandError("wait: %v", err)
+			continue
+		}
+		for !job.Done {
+			s.jobs.changed.Wait()
+		}
+		s.jobs.remove(job)
+		status = job.Status
+	}
+	return status
+}
@@ -4,12 +4,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -21,19 +20,44 @@ import (
 
 var ushVersion = "devel"
 
-var varRegexp = regexp.MustCompile(`\$[a-zA-Z_]+`)
-
-var currentCmd *exec.Cmd
 var currentState *State
 
 type State struct {
 	Cwd             string
 	IsInteractive   bool
 	Aliases         map[string]string
+	Vars            map[string]*Variable
+	Functions       map[string]*parser.FunctionDef
+	Name            string   // name of the shell or of the script it runs, as $0
+	Positional      []string // positional parameters, $1 being the first one
+	LastStatus      int
+	PipeStatus      []int           // exit statuses of the last pipeline's commands
+	Options         map[string]bool // options enabled with `set -o`
+	ShellOptions    map[string]bool // options enabled with `shopt -s`
 	prompt          *prompt.Prompt
 	configFileName  string
 	historyFileName string
 	history         string
+
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	jobs *JobTable
+	job  *Job // job processes started by this state belong to, nil for new jobs
+
+	loops      int // number of loops being run
+	breaking   int // number of loops `break` is leaving
+	continuing int // number of loops `continue` is leaving, the last one continuing
+	calls      int // number of function calls and sourced files being run
+	returning  bool
+	locals     []map[string]*Variable // for each function call, variables its `local` shadows, nil when unset
+
+	lastArg            string // last argument of the previous command, as $_
+	lastBackground     *Job   // last job started in the background, for $!
+	isSubshell         bool   // true for copies of the shell made by subshell()
+	exiting            bool   // true once `exit` ran in a subshell, which then stops
+	substitutionStatus int    // exit status of the last command substitution
 }
 
 func NewState() *State {
@@ -41,10 +65,19 @@ func NewState() *State {
 		Cwd:             "/",
 		IsInteractive:   false,
 		Aliases:         map[string]string{},
+		Name:            os.Args[0],
+		Vars:            importEnviron(),
+		Functions:       map[string]*parser.FunctionDef{},
+		Options:         map[string]bool{},
+		ShellOptions:    map[string]bool{},
 		prompt:          prompt.NewPrompt(),
 		configFileName:  "",
 		historyFileName: "",
 		history:         "",
+		stdin:           os.Stdin,
+		stdout:          os.Stdout,
+		stderr:          os.Stderr,
+		jobs:            NewJobTable(),
 	}
 	s.prompt.SetCompletionFn(s.defaultAutocomplete)
 
@@ -52,6 +85,7 @@ func NewState() *State {
 		s.ReportError("error reading current directory")
 	} else {
 		s.Cwd = cwd
+		s.Vars["PWD"] = &Variable{Value: cwd, Exported: true}
 	}
 
 	homeDir := os.Getenv("HOME")
@@ -74,6 +108,8 @@ func NewState() *State {
 }
 
 func (s *State) Quit(statusCode int) {
+	s.jobs.Hangup()
+
 	// Save history to disk
 	history := []byte(s.prompt.History())
 	if err := ioutil.WriteFile(s.historyFileName, history, 0755); err != nil {
@@ -84,21 +120,37 @@ func (s *State) Quit(statusCode int) {
 }
 
 func (s *State) ReportError(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "ush: "+format+"\n", args...)
+	fmt.Fprintf(s.stderr, "ush: "+format+"\n", args...)
 	if !s.IsInteractive {
-		s.Quit(1)
+		s.exit(1)
 	}
 }
 
+// Reports an error about a command without quitting the shell, returning the
+// exit status that command should have
+func (s *State) ReportCommandError(format string, args ...interface{}) int {
+	fmt.Fprintf(s.stderr, "ush: "+format+"\n", args...)
+	return 1
+}
+
 func (s *State) defaultAutocomplete(line string) []string {
 	// Parse current line
-	pipes := s.ParseLine(line)
+	tokens, err := parser.Parse(line)
+	if err != nil {
+		return []string{}
+	}
 	parts := []string{}
-	for i := range pipes {
-		if i > 0 {
-			parts = append(parts, "|")
+	for _, token := range tokens {
+		if token.Type == parser.WordToken {
+			part := token.Value
+			if dir, rest, ok := s.expandTilde(part, "/"); ok {
+				part = dir + rest
+			}
+			// Completing must not run commands or assign variables
+			parts = append(parts, s.expandPlainVariables(part))
+		} else {
+			parts = append(parts, token.Value)
 		}
-		parts = append(parts, pipes[i]...)
 	}
 
 	// If we didn't write anything yet well have problem indexing later, do the simple case
@@ -127,174 +179,521 @@ func (s *State) defaultAutocomplete(line string) []string {
 	}
 }
 
-func (s *State) ParseLine(line string) [][]string {
-	words, err := parser.Parse(line)
+func (s *State) ParseLine(line string) *parser.List {
+	list, err := parser.ParseList(line)
 	if err != nil {
-		s.ReportError("error parsing line [%s] %v", line, err)
+		// Like other errors, but non-interactive shells exit with 2
+		fmt.Fprintf(s.stderr, "ush: error parsing line [%s] %v\n", line, err)
+		if !s.IsInteractive {
+			s.exit(2)
+		}
+		return nil
 	}
+	return s.expandAliases(list, map[string]bool{})
+}
 
-	commands := make([][]string, 0)
-	cmd := make([]string, 0)
-
-	for _, word := range words {
-		trimed := strings.TrimSpace(word)
-
-		// Handle comments
-		if len(trimed) > 0 && trimed[0] == '#' {
-			break
+// Replaces aliases starting pipelines with the commands they stand for. An
+// alias found in seen is being expanded already and is left as is.
+func (s *State) expandAliases(list *parser.List, seen map[string]bool) *parser.List {
+	expanded := &parser.List{}
+	for i, pipeline := range list.Pipelines {
+		first := pipeline.Commands[0]
+		if len(first.Args) == 0 || seen[first.Args[0]] {
+			expanded.Pipelines = append(expanded.Pipelines, pipeline)
+			expanded.Operators = append(expanded.Operators, list.Operators[i])
+			continue
 		}
-
-		// Handle ~ as $HOME
-		if len(trimed) > 0 && trimed[0] == '~' {
-			trimed = filepath.Join(os.Getenv("HOME"), trimed[1:])
+		value, ok := s.Aliases[first.Args[0]]
+		if !ok {
+			expanded.Pipelines = append(expanded.Pipelines, pipeline)
+			expanded.Operators = append(expanded.Operators, list.Operators[i])
+			continue
 		}
+		aliased, err := parser.ParseList(value)
+		if err != nil || len(aliased.Pipelines) == 0 {
+			s.ReportError("error parsing alias %s [%s] %v", first.Args[0], value, err)
+			expanded.Pipelines = append(expanded.Pipelines, pipeline)
+			expanded.Operators = append(expanded.Operators, list.Operators[i])
+			continue
+		}
+		seen[first.Args[0]] = true
+		aliased = s.expandAliases(aliased, seen)
+		delete(seen, first.Args[0])
+
+		// The alias' last command gets the arguments, redirections and
+		// following pipeline stages
+		aliased.Pipelines[0].Negated = aliased.Pipelines[0].Negated != pipeline.Negated
+		aliasedFirst := aliased.Pipelines[0].Commands[0]
+		aliasedFirst.Assignments = append(first.Assignments, aliasedFirst.Assignments...)
+		last := aliased.Pipelines[len(aliased.Pipelines)-1]
+		lastCommand := last.Commands[len(last.Commands)-1]
+		lastCommand.Args = append(lastCommand.Args, first.Args[1:]...)
+		lastCommand.Words = append(lastCommand.Words, first.Words[1:]...)
+		lastCommand.Redirects = append(lastCommand.Redirects, first.Redirects...)
+		last.Commands = append(last.Commands, pipeline.Commands[1:]...)
+
+		expanded.Pipelines = append(expanded.Pipelines, aliased.Pipelines...)
+		// The operator ending the alias is replaced by the one following it
+		expanded.Operators = append(expanded.Operators, aliased.Operators[:len(aliased.Operators)-1]...)
+		expanded.Operators = append(expanded.Operators, list.Operators[i])
+	}
 
-		// Expand/Replace variables
-		trimed = varRegexp.ReplaceAllStringFunc(trimed, func(match string) string {
-			return os.Getenv(match[1:])
-		})
-
-		if len(trimed) > 0 && trimed[0] == '*' {
-			// Handle basic glob
-			expandeds, err := filepath.Glob(trimed)
-			if err != nil {
-				log.Fatal(err)
+	for _, pipeline := range expanded.Pipelines {
+		for _, command := range pipeline.Commands {
+			if command.Compound != nil {
+				s.expandCompoundAliases(command.Compound, seen)
 			}
-			cmd = append(cmd, expandeds...)
-		} else if trimed == "|" {
-			commands = append(commands, cmd)
-			cmd = make([]string, 0)
-		} else {
-			cmd = append(cmd, trimed)
 		}
 	}
+	return expanded
+}
 
-	if len(cmd) > 0 {
-		commands = append(commands, cmd)
+// Replaces aliases in the lists making up a compound command
+func (s *State) expandCompoundAliases(compound parser.Compound, seen map[string]bool) {
+	switch compound := compound.(type) {
+	case *parser.IfClause:
+		for i := range compound.Conditions {
+			compound.Conditions[i] = s.expandAliases(compound.Conditions[i], seen)
+			compound.Bodies[i] = s.expandAliases(compound.Bodies[i], seen)
+		}
+		if compound.Else != nil {
+			compound.Else = s.expandAliases(compound.Else, seen)
+		}
+	case *parser.WhileLoop:
+		compound.Condition = s.expandAliases(compound.Condition, seen)
+		compound.Body = s.expandAliases(compound.Body, seen)
+	case *parser.ForLoop:
+		compound.Body = s.expandAliases(compound.Body, seen)
+	case *parser.CaseClause:
+		for _, item := range compound.Items {
+			item.Body = s.expandAliases(item.Body, seen)
+		}
+	case *parser.FunctionDef:
+		compound.Body = s.expandAliases(compound.Body, seen)
+	case *parser.BraceGroup:
+		compound.Body = s.expandAliases(compound.Body, seen)
+	case *parser.Subshell:
+		compound.Body = s.expandAliases(compound.Body, seen)
 	}
-
-	return commands
 }
 
-// {{{ Execute
-func commandErrorExitCode(err error) (int, bool) {
-	if exiterr, ok := err.(*exec.ExitError); ok {
-		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-			return status.ExitStatus(), true
+// Keeps appending lines returned by next to line for as long as it is an
+// incomplete command, like an unterminated quote or here-document
+func completeLine(line string, next func() (string, error)) (string, error) {
+	for {
+		if _, err := parser.ParseList(line); !parser.IsIncomplete(err) {
+			return line, nil
 		}
+		more, err := next()
+		if err != nil {
+			return line, err
+		}
+		line += "\n" + more
 	}
-	return 0, false
 }
 
-func (s *State) createSubprocess(command []string, in *io.PipeReader, out *io.PipeWriter, ch chan<- bool) {
-	go func() {
-		cmd := exec.Command(command[0], command[1:]...)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+// {{{ Execute
+// Returns the exit status for a command that couldn't be started, 127 when
+// it can't be found and 126 when it can't be executed
+func commandStartExitCode(err error) int {
+	if execErr, ok := err.(*exec.Error); ok {
+		err = execErr.Err
+	}
+	if err == exec.ErrNotFound || os.IsNotExist(err) {
+		return 127
+	}
+	return 126
+}
 
+// Starts a stage of a pipeline, calling done with its exit status once it
+// finishes. External commands are started before returning, so their process
+// is part of the job right away, other commands run in a goroutine.
+func (s *State) createSubprocess(command *parser.Command, in *os.File, out *os.File, done func(int)) {
+	// Each stage gets its own copy of the state to hold its streams
+	stage := *s
+	if in != nil {
+		stage.stdin = in
+	}
+	if out != nil {
+		stage.stdout = out
+	}
+	closePipes := func() {
 		if in != nil {
-			cmd.Stdin = in
+			in.Close()
 		}
 		if out != nil {
-			cmd.Stdout = out
+			out.Close()
 		}
+	}
 
-		err := cmd.Start()
-		if err != nil {
-			s.ReportError("error running [%s] %v", parser.Format(command...), err)
-		} else {
-			currentCmd = cmd // Set global for signal fowarding
-			err = cmd.Wait()
-			if err != nil {
-				if statusCode, ok := commandErrorExitCode(err); ok {
-					os.Setenv("exit", strconv.Itoa(statusCode))
-				} else {
-					s.ReportError("error running [%s] %v", parser.Format(command...), err)
-				}
+	if s.isExternal(command) {
+		cmd, proc, files, status := stage.startCommand(command)
+		// The started process has its own copy of the pipes, closing ours
+		// lets it see the end of its input or get SIGPIPE
+		closePipes()
+		go func() {
+			if cmd != nil {
+				status = stage.waitProcess(cmd, proc)
 			}
+			closeFiles(files)
+			done(status)
+		}()
+		return
+	}
+
+	// Changes other commands make to variables don't outlive the pipeline
+	sub := stage.subshell()
+	go func() {
+		status := sub.runInShell(command)
+		closePipes()
+		done(status)
+	}()
+}
+
+// Returns true if a command runs an external program, rather than a
+// function, a builtin or a compound command
+func (s *State) isExternal(command *parser.Command) bool {
+	if command.Compound != nil || len(command.Args) == 0 {
+		return false
+	}
+	if _, ok := s.Functions[command.Args[0]]; ok {
+		return false
+	}
+	_, ok := builtins[command.Args[0]]
+	return !ok
+}
+
+// Runs a command that isn't external in the shell itself
+func (s *State) runInShell(command *parser.Command) int {
+	if command.Compound != nil {
+		return s.runCompound(command)
+	}
+	if len(command.Args) == 0 {
+		// Only assignments and redirections, like `> file` which creates or
+		// truncates file
+		return s.withRedirects(command, func() int {
+			return s.assign(command.Assignments)
+		})
+	}
+	return s.withAssignments(command.Assignments, func() int {
+		if fn, ok := s.Functions[command.Args[0]]; ok {
+			return s.withRedirects(command, func() int {
+				return s.callFunction(fn, command.Args)
+			})
 		}
-		if in != nil {
-			in.Close()
+		return s.runBuiltin(builtins[command.Args[0]], command)
+	})
+}
+
+// Starts an external command with its redirections applied, adding it to the
+// state's job. When it can't be started, a nil command is returned along with
+// an exit status. The returned files need closing once the command is done.
+func (s *State) startCommand(command *parser.Command) (*exec.Cmd, *Process, []*os.File, int) {
+	files, err := s.applyRedirects(command.Redirects)
+	if err != nil {
+		return nil, nil, files, s.ReportCommandError("error redirecting [%s] %v", parser.Format(command.Args...), err)
+	}
+
+	// Variables assigned before the command only apply to it
+	child := s
+	if len(command.Assignments) > 0 {
+		child = s.subshell()
+		if err := child.exportAssignments(command.Assignments); err != nil {
+			return nil, nil, files, s.ReportCommandError("%v", err)
 		}
-		if out != nil {
-			out.Close()
+	}
+	path, err := child.lookPath(command.Args[0])
+	if err != nil {
+		s.ReportCommandError("error running [%s] %v", parser.Format(command.Args...), err)
+		return nil, nil, files, commandStartExitCode(err)
+	}
+	cmd := exec.Command(path, command.Args[1:]...)
+	cmd.Args[0] = command.Args[0]
+	cmd.Env = child.environ()
+	cmd.Dir = s.Cwd
+	cmd.Stdin = s.stdin
+	cmd.Stdout = s.stdout
+	cmd.Stderr = s.stderr
+	cmd.SysProcAttr = s.jobs.processAttr(s.job)
+
+	if err := cmd.Start(); err != nil {
+		s.ReportCommandError("error running [%s] %v", parser.Format(command.Args...), err)
+		return nil, nil, files, commandStartExitCode(err)
+	}
+	return cmd, s.jobs.addProcess(s.job, cmd.Process.Pid, cmd.SysProcAttr), files, 0
+}
+
+// Runs a builtin with the command's redirections applied to the state's
+// streams for the duration of the call
+func (s *State) runBuiltin(builtin func(*State, []string) int, command *parser.Command) int {
+	return s.withRedirects(command, func() int {
+		return builtin(s, command.Args)
+	})
+}
+
+// Runs a compound command with its redirections applied to the state's
+// streams for the duration of the call
+func (s *State) runCompound(command *parser.Command) int {
+	return s.withRedirects(command, func() int {
+		switch compound := command.Compound.(type) {
+		case *parser.IfClause:
+			return s.executeIf(compound)
+		case *parser.WhileLoop:
+			return s.executeWhile(compound)
+		case *parser.ForLoop:
+			return s.executeFor(compound)
+		case *parser.CaseClause:
+			return s.executeCase(compound)
+		case *parser.FunctionDef:
+			s.Functions[compound.Name] = compound
+			return 0
+		case *parser.BraceGroup:
+			return s.Execute(compound.Body)
+		case *parser.Subshell:
+			return s.subshell().Execute(compound.Body)
+		case *parser.ArithmeticCommand:
+			value, err := s.expandArithmetic(compound.Expression)
+			if err != nil {
+				return s.ReportCommandError("%v", err)
+			}
+			return arithmeticStatus(value)
 		}
+		return s.ReportCommandError("unknown command [%s]", command)
+	})
+}
 
-		ch <- true
-	}()
+// Calls run with the command's redirections applied to the state's streams,
+// restoring them afterwards
+func (s *State) withRedirects(command *parser.Command, run func() int) int {
+	stdin, stdout, stderr := s.stdin, s.stdout, s.stderr
+	files, err := s.applyRedirects(command.Redirects)
+	status := 0
+	if err != nil {
+		status = s.ReportCommandError("error redirecting [%s] %v", command, err)
+	} else {
+		status = run()
+	}
+	closeFiles(files)
+	s.stdin, s.stdout, s.stderr = stdin, stdout, stderr
+	return status
 }
 
 type DataPipes struct {
-	in  *io.PipeReader
-	out *io.PipeWriter
+	in  *os.File
+	out *os.File
 }
 
-func makeSubprocessPipes(processes int) []*DataPipes {
+// Creates the pipes connecting the stages of a pipeline, one less than there
+// are stages
+func makeSubprocessPipes(processes int) ([]*DataPipes, error) {
 	pipes := make([]*DataPipes, 0)
-	for i := 0; i < processes; i++ {
-		in, out := io.Pipe()
+	for i := 0; i < processes-1; i++ {
+		in, out, err := os.Pipe()
+		if err != nil {
+			for _, data := range pipes {
+				data.in.Close()
+				data.out.Close()
+			}
+			return nil, err
+		}
 		data := &DataPipes{in, out}
 		pipes = append(pipes, data)
 	}
-	return pipes
+	return pipes, nil
 }
 
-func waitSubprocess(processes int, ch <-chan bool) {
-	for i := 0; i < processes; i++ {
-		<-ch
+// Waits for the given number of pipeline stages to be done, or for the job to
+// get stopped when stoppable is true. Returns the number of stages still
+// running. The caller must be holding the job table's lock.
+func (s *State) waitSubprocess(job *Job, remaining *int, stoppable bool) int {
+	for *remaining > 0 && !(stoppable && job.Stopped()) {
+		s.jobs.changed.Wait()
 	}
+	return *remaining
 }
 
-func (s *State) Execute(commands [][]string) {
-	if len(commands) == 0 || len(commands[0]) == 0 {
-		return // Skip empty commands
+// Execute runs a list of pipelines, skipping those following a `&&` or a `||`
+// as needed, and returns the exit status of the last pipeline ran. It stops
+// early when `break` or `continue` leaves the enclosing loop.
+func (s *State) Execute(list *parser.List) int {
+	status := s.LastStatus
+	for i := 0; i < len(list.Pipelines) && !s.leaving(); i++ {
+		if i > 0 {
+			op := list.Operators[i-1]
+			if (op == "&&" && status != 0) || (op == "||" && status == 0) {
+				continue
+			}
+		}
+
+		// Find where the and-or list starting here ends, to know if it needs
+		// to run in the background
+		end := i
+		for list.Operators[end] == "&&" || list.Operators[end] == "||" {
+			end++
+		}
+		if list.Operators[end] == "&" {
+			operators := append([]string{}, list.Operators[i:end+1]...)
+			operators[len(operators)-1] = ";"
+			status = s.executeBackground(&parser.List{Pipelines: list.Pipelines[i : end+1], Operators: operators})
+			i = end
+		} else {
+			status = s.executePipeline(list.Pipelines[i], false)
+		}
+		s.LastStatus = status
+		if !s.IsInteractive {
+			// Nothing notifies about finished jobs, which would pile up
+			s.jobs.Prune()
+		}
 	}
+	return status
+}
 
-	arg0 := commands[0][0]
+// Starts an and-or list in the background as a new job. A single pipeline is
+// started right away, longer lists run in a goroutine on a copy of the state.
+func (s *State) executeBackground(list *parser.List) int {
+	if len(list.Pipelines) == 1 {
+		return s.executePipeline(list.Pipelines[0], true)
+	}
 
-	// Handle builtins
-	if arg0 == "exit" {
-		s.BuiltinExit(commands[0])
-		return
-	} else if arg0 == "help" {
-		s.BuiltinHelp(commands[0])
-		return
-	} else if arg0 == "exec" {
-		s.BuiltinExec(commands[0])
-		return
-	} else if arg0 == "cd" {
-		s.BuiltinCd(commands[0])
-		return
-	} else if arg0 == "set" {
-		s.BuiltinSet(commands[0])
-		return
-	} else if arg0 == "unset" {
-		s.BuiltinUnset(commands[0])
-		return
-	} else if arg0 == "alias" {
-		s.BuiltinAlias(commands[0])
-		return
-	} else if arg0 == "source" {
-		s.BuiltinSource(commands[0])
+	job := &Job{Command: list.String(), notified: "Running"}
+	bg := s.subshell()
+	bg.job = job
+	var devNull *os.File
+	if !s.jobs.control {
+		var err error
+		if devNull, err = os.Open(os.DevNull); err != nil {
+			return s.ReportCommandError("error opening %s %v", os.DevNull, err)
+		}
+		bg.stdin = devNull // Without job control, background jobs can't read the terminal
+	}
+
+	s.jobs.mu.Lock()
+	s.jobs.add(job)
+	s.jobs.mu.Unlock()
+	s.lastBackground = job
+	s.reportBackgroundJob(job)
+
+	go func() {
+		status := bg.Execute(list)
+		if devNull != nil {
+			devNull.Close()
+		}
+		s.jobs.mu.Lock()
+		s.jobs.finish(job, status)
+		s.jobs.mu.Unlock()
+	}()
+	return 0
+}
+
+// Prints the id of a job started in the background, along with the process id
+// of its last process when known
+func (s *State) reportBackgroundJob(job *Job) {
+	if !s.IsInteractive {
 		return
 	}
+	if pid := job.Pid(); pid != 0 {
+		fmt.Fprintf(s.stderr, "[%d] %d\n", job.Id, pid)
+	} else {
+		fmt.Fprintf(s.stderr, "[%d]\n", job.Id)
+	}
+}
+
+func (s *State) executePipeline(pipeline *parser.Pipeline, background bool) int {
+	commands := make([]*parser.Command, 0, len(pipeline.Commands))
+	for _, command := range pipeline.Commands {
+		expanded, err := s.expandCommand(command)
+		if err != nil {
+			s.PipeStatus = []int{1}
+			return s.reportExpansionError(err)
+		}
+		commands = append(commands, expanded)
+	}
+
+	statuses := s.runPipeline(commands, background)
+	if args := commands[len(commands)-1].Args; len(args) > 0 {
+		s.lastArg = args[len(args)-1]
+	}
+	if statuses == nil {
+		return 0 // Started in the background
+	}
+	s.PipeStatus = statuses
+	status := s.pipelineStatus(statuses)
+	if pipeline.Negated {
+		if status == 0 {
+			return 1
+		}
+		return 0
+	}
+	return status
+}
 
-	// Replace aliases with aliased commands
-	if value, ok := s.Aliases[arg0]; ok {
-		commandRest := commands[0][1:]
-		commandsRest := commands[1:]
-		commands = s.ParseLine(value)
-		commands[len(commands)-1] = append(commands[len(commands)-1], commandRest...)
-		commands = append(commands, commandsRest...)
+// Reports an error met while expanding a command, returning the exit status
+// the command should have
+func (s *State) reportExpansionError(err error) int {
+	if _, ok := err.(*parameterError); ok {
+		s.ReportError("%v", err) // Exits non-interactive shells
+		return 1
+	}
+	return s.ReportCommandError("%v", err)
+}
+
+// Returns a pipeline's exit status from the statuses of its commands, the
+// last one's or, with pipefail, the last non-zero one
+func (s *State) pipelineStatus(statuses []int) int {
+	status := statuses[len(statuses)-1]
+	if s.Options["pipefail"] {
+		for _, st := range statuses {
+			if st != 0 {
+				status = st
+			}
+		}
+	}
+	return status
+}
+
+// Runs the commands of a pipeline and returns the exit status of each one. In
+// the background, or when stopped, the pipeline is added to the job table and
+// keeps running after this returns, nil being returned for background ones.
+func (s *State) runPipeline(commands []*parser.Command, background bool) []int {
+	// Functions, builtins and compound commands run in the shell itself
+	// unless part of a pipeline
+	if !background && len(commands) == 1 && !s.isExternal(commands[0]) {
+		return []int{s.runInShell(commands[0])}
+	}
+
+	// Pipelines are jobs of their own, unless ran as part of a background list
+	runner := *s
+	if runner.job == nil || background {
+		runner.job = &Job{Command: formatCommands(commands)}
+	}
+	job := runner.job
+	owner := job != s.job
+	var devNull *os.File
+	if background && !s.jobs.control {
+		var err error
+		if devNull, err = os.Open(os.DevNull); err != nil {
+			return []int{s.ReportCommandError("error opening %s %v", os.DevNull, err)}
+		}
+		runner.stdin = devNull // Without job control, background jobs can't read the terminal
 	}
 
 	processCount := len(commands)
-	pipes := makeSubprocessPipes(processCount)
-	ch := make(chan bool, len(commands))
+	pipes, err := makeSubprocessPipes(processCount)
+	if err != nil {
+		if devNull != nil {
+			devNull.Close()
+		}
+		return []int{s.ReportCommandError("error creating pipes %v", err)}
+	}
+	if owner && !background {
+		s.jobs.mu.Lock()
+		s.jobs.foreground = job
+		s.jobs.mu.Unlock()
+	}
+	statuses := make([]int, processCount)
+	remaining := processCount // Guarded by the job table's lock
 	for i, command := range commands {
-		var in *io.PipeReader
-		var out *io.PipeWriter
+		var in, out *os.File
 
 		if i != 0 {
 			in = pipes[i-1].in
@@ -303,114 +702,535 @@ func (s *State) Execute(commands [][]string) {
 			out = pipes[i].out
 		}
 
-		s.createSubprocess(command, in, out, ch)
+		index := i
+		runner.createSubprocess(command, in, out, func(status int) {
+			s.jobs.mu.Lock()
+			statuses[index] = status
+			remaining--
+			s.jobs.changed.Broadcast()
+			s.jobs.mu.Unlock()
+		})
 	}
 
-	waitSubprocess(processCount, ch)
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+
+	if !background {
+		s.waitSubprocess(job, &remaining, owner)
+		if owner {
+			s.jobs.foreground = nil
+			s.jobs.setTerminalJob(nil)
+		}
+		if remaining == 0 {
+			return statuses
+		}
+	}
+
+	// The job goes on in the background
+	s.jobs.add(job)
+	go func() {
+		s.jobs.mu.Lock()
+		s.waitSubprocess(job, &remaining, false)
+		if devNull != nil {
+			devNull.Close() // Only once the job's processes, or goroutines, are done
+		}
+		s.jobs.finish(job, s.pipelineStatus(statuses))
+		s.jobs.mu.Unlock()
+	}()
+	if background {
+		job.notified = "Running"
+		s.lastBackground = job
+		s.reportBackgroundJob(job)
+		return nil
+	}
+
+	stopped := make([]int, processCount)
+	for i := range stopped {
+		stopped[i] = 128 + int(syscall.SIGTSTP)
+	}
+	return stopped
+}
+
+func formatCommands(commands []*parser.Command) string {
+	parts := make([]string, len(commands))
+	for i, command := range commands {
+		parts[i] = command.String()
+	}
+	return strings.Join(parts, " | ")
 }
 
 // }}}
 
-func (s *State) ExecuteLine(line string) {
-	s.Execute(s.ParseLine(line))
+func (s *State) ExecuteLine(line string) int {
+	list := s.ParseLine(line)
+	if list == nil {
+		s.LastStatus = 2 // Syntax error
+		return s.LastStatus
+	}
+	return s.Execute(list)
 }
 
-func (s *State) ExecuteFile(fileName string) {
-	if contents, err := ioutil.ReadFile(fileName); err != nil {
+func (s *State) ExecuteFile(fileName string) int {
+	status := 0
+	if contents, err := ioutil.ReadFile(s.absPath(fileName)); err != nil {
 		s.ReportError("errror reading file: %v", fileName)
+		status = 1
 	} else {
-		for _, line := range strings.Split(string(contents), "\n") {
-			s.ExecuteLine(line)
+		lines := strings.Split(string(contents), "\n")
+		next := func() (string, error) {
+			if len(lines) == 0 {
+				return "", io.EOF
+			}
+			line := lines[0]
+			lines = lines[1:]
+			return line, nil
+		}
+		for len(lines) > 0 && !s.returning && !s.exiting {
+			line, _ := next()
+			line, _ = completeLine(line, next)
+			status = s.ExecuteLine(line)
+		}
+	}
+	return status
+}
+
+var builtins map[string]func(*State, []string) int
+
+func init() {
+	builtins = map[string]func(*State, []string) int{
+		"exit":     (*State).BuiltinExit,
+		"help":     (*State).BuiltinHelp,
+		"exec":     (*State).BuiltinExec,
+		"cd":       (*State).BuiltinCd,
+		"set":      (*State).BuiltinSet,
+		"unset":    (*State).BuiltinUnset,
+		"alias":    (*State).BuiltinAlias,
+		"source":   (*State).BuiltinSource,
+		"jobs":     (*State).BuiltinJobs,
+		"fg":       (*State).BuiltinFg,
+		"bg":       (*State).BuiltinBg,
+		"wait":     (*State).BuiltinWait,
+		"let":      (*State).BuiltinLet,
+		"break":    (*State).BuiltinBreak,
+		"continue": (*State).BuiltinContinue,
+		"return":   (*State).BuiltinReturn,
+		"shift":    (*State).BuiltinShift,
+		"local":    (*State).BuiltinLocal,
+		"export":   (*State).BuiltinExport,
+		"readonly": (*State).BuiltinReadonly,
+		"shopt":    (*State).BuiltinShopt,
+	}
+}
+
+func (s *State) BuiltinExit(args []string) int {
+	if len(args) > 2 {
+		return s.ReportCommandError("exit needs at most 1 argument, got [%s]", parser.Format(args...))
+	}
+	status := s.LastStatus
+	if len(args) == 2 {
+		var err error
+		if status, err = strconv.Atoi(args[1]); err != nil {
+			s.ReportCommandError("exit needs a numeric argument, got [%s]", args[1])
+			status = 2
 		}
 	}
+	s.exit(status & 0xff)
+	return status & 0xff
 }
 
-func (s *State) BuiltinExit(args []string) {
-	s.Quit(0)
+// Exits the shell, or only stops a subshell since it runs within the shell's
+// process
+func (s *State) exit(status int) {
+	if s.isSubshell {
+		s.exiting = true
+		return
+	}
+	s.Quit(status)
 }
 
-func (s *State) BuiltinHelp(args []string) {
-	fmt.Fprintf(os.Stderr, `ush: a shell with a microscopic feature set
+func (s *State) BuiltinHelp(args []string) int {
+	fmt.Fprintf(s.stdout, `ush: a shell with a microscopic feature set
 
 Args
 
   -v --version  Show ush's version
   -h --help     Show this message
-  -c            Run the following command and exit
+  -c            Run the following command and exit with its status
 
 Builtins
 
   help    Show this message
-  exit    Exit the shell
+  exit    Exit the shell, with the given status or the last command's
   exec    Replaces shell with new process
   cd      Change the current directory
-  set     Set an environment variable's value
-  unset   Delete an environment variable
-  alias   Register an alias for a command
+  set     Set a variable's value, or options with -o and +o
+  unset   Delete variables
+  export  Pass variables, optionally setting them as name=value, to commands
+  readonly
+          Make variables, optionally set as name=value, read-only
+  alias   Register an alias for a command, or list aliases
   source  Load and execute a file
+  jobs    List background and stopped jobs
+  fg      Resume a job in the foreground
+  bg      Resume a stopped job in the background
+  wait    Wait for background jobs to finish
+  let     Evaluate arithmetic expressions
+  break   Leave the enclosing loop, or the given number of them
+  continue
+          Start the next iteration of the enclosing loop, or of the given one
+  return  Return from a function, with the given status or the last command's
+  shift   Drop the first positional parameter, or the given number of them
+  local   Set variables that only last until the function returns
+  shopt   Enable (-s) or disable (-u) glob options, or list them
+
+Lists
+
+  a; b      Run a then b
+  a && b    Run b only if a succeeded
+  a || b    Run b only if a failed
+  ! a       Invert a's exit status
+  a &       Run a in the background, ctrl-z stops the running command
+  ((expr))  Succeed if the arithmetic expression expr isn't 0
+  (a; b)    Run a then b in a subshell, whose changes don't last
+  { a; b; } Run a then b as a single command, for redirections and pipes
+
+Conditionals
+
+  if a; then b; elif c; then d; else e; fi
+            Run b if a succeeded, else d if c succeeded, else e
+
+Loops
+
+  while a; do b; done
+            Run b for as long as a succeeds, until does it as long as it fails
+  for x in a b c; do d; done
+            Run d with x set to a, then b, then c
+
+  case $x in a|b*) c;; *) d;; esac
+            Run c if $x is a or starts with b, d otherwise
+
+Variables
+
+  NAME=value
+            Set the NAME variable, export NAME passes it to commands
+  NAME=value cmd
+            Run cmd with NAME set and exported, for cmd only
+
+Functions
+
+  f() { a; }
+            Define f, running a with $1, $2... set to f's arguments
+
+Expansions
+
+  a{b,c}    Words ab and ac, {1..5}, {01..10..2} and {a..e} for sequences
+  ~         Your home directory, ~user for user's, ~+ and ~- for $PWD and $OLDPWD
+  $NAME     Value of the NAME variable, ${NAME} works too
+  $1 $@ $#  First positional parameter, all of them and their number
+  $0 $$ $!  Shell or script name, shell process id, last background process id
+  $- $_     Active option letters, last argument of the previous command
+  ${NAME:-word} ${NAME:=word} ${NAME:?msg} ${NAME:+word}
+            Default, assigned default, error and alternate values
+  ${#NAME}  Length of NAME's value
+  ${NAME#pat} ${NAME##pat} ${NAME%%pat} ${NAME%%%%pat}
+            NAME's value without its prefix or suffix matching pat
+  ${NAME/a/b} ${NAME//a/b}
+            NAME's value with matches of a replaced by b
+  $(cmd)    Output of cmd, `+"`cmd`"+` works too
+  $((expr)) Value of the arithmetic expression expr
+  $'a\tb'   Text with C-style escapes like \t, \n, \e, \x1b or \u2713
+  *.txt     Files matching a glob, with * ? [a-z] and ** for any directories
+
+Redirections
+
+  < file    Read stdin from file
+  <<EOF     Read stdin from the following lines, up to EOF
+  <<< word  Read stdin from word
+  > file    Write stdout to file
+  >> file   Append stdout to file
+  2> file   Write stderr to file (2>> to append)
+  2>&1      Send stderr where stdout goes
+  &> file   Write both stdout and stderr to file
 
 `)
+	return 0
 }
 
-func (s *State) BuiltinExec(args []string) {
+func (s *State) BuiltinExec(args []string) int {
 	if len(args) <= 1 {
-		s.ReportError("exec needs at least 1 argument")
-		return
+		return s.ReportCommandError("exec needs at least 1 argument")
 	}
-	err := syscall.Exec(args[1], args[1:], os.Environ())
+	path, err := s.lookPath(args[1])
 	if err != nil {
-		s.ReportError("error calling exec: %v: %v", args, err.Error())
+		s.ReportCommandError("error calling exec: %v: %v", args, err)
+		if s.isSubshell {
+			s.exit(commandStartExitCode(err))
+		}
+		return commandStartExitCode(err)
 	}
+	path = s.absPath(path)
+
+	// Subshells run within the shell's process, which exec must not replace:
+	// the program runs as a child process instead, the subshell ending with
+	// its exit status
+	if s.isSubshell {
+		status := s.runChild(path, args[1:])
+		s.exit(status)
+		return status
+	}
+
+	// The program inherits the process' standard file descriptors, which
+	// need to point where the command's redirections sent the shell's streams
+	if err := s.dupStreams(); err != nil {
+		return s.ReportCommandError("error calling exec: %v: %v", args, err)
+	}
+	if err := os.Chdir(s.Cwd); err != nil {
+		return s.ReportCommandError("error calling exec: %v: %v", args, err)
+	}
+	err = syscall.Exec(path, args[1:], s.environ())
+	s.ReportCommandError("error calling exec: %v: %v", args, err)
+	return commandStartExitCode(err)
+}
+
+// Runs a program as a child process with the shell's streams, directory and
+// exported variables, waiting for it to finish
+func (s *State) runChild(path string, args []string) int {
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Args[0] = args[0]
+	cmd.Env = s.environ()
+	cmd.Dir = s.Cwd
+	cmd.Stdin = s.stdin
+	cmd.Stdout = s.stdout
+	cmd.Stderr = s.stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return exitErr.ExitCode()
+	} else if err != nil {
+		s.ReportCommandError("error calling exec: %v: %v", parser.Format(args...), err)
+		return commandStartExitCode(err)
+	}
+	return 0
 }
 
-func (s *State) BuiltinCd(args []string) {
-	var err error
+// Makes the shell's stdin, stdout and stderr the process' file descriptors 0,
+// 1 and 2, when they are files other than these
+func (s *State) dupStreams() error {
+	for fd, stream := range []interface{}{s.stdin, s.stdout, s.stderr} {
+		if f, ok := stream.(*os.File); ok && int(f.Fd()) != fd {
+			if err := syscall.Dup3(int(f.Fd()), fd, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *State) BuiltinCd(args []string) int {
+	dir := s.getVar("HOME")
 	if len(args) > 1 {
-		err = os.Chdir(args[1])
-	} else {
-		err = os.Chdir(os.Getenv("HOME"))
+		dir = args[1]
+	}
+	cwd := filepath.Clean(s.absPath(dir))
+	info, err := os.Stat(cwd)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s: not a directory", dir)
+	} else if err == nil && !s.isSubshell {
+		// The process follows the shell's directory, subshells only keep
+		// track of their own
+		err = os.Chdir(cwd)
+	}
+	if pathErr, ok := err.(*os.PathError); ok {
+		pathErr.Op, pathErr.Path = "chdir", dir
 	}
 	if err != nil {
-		s.ReportError("error changing directory %v", err)
+		return s.ReportCommandError("error changing directory %v", err)
 	}
 
-	if cwd, err := os.Getwd(); err != nil {
-		s.ReportError("error getting current directory %v", err)
-	} else {
-		s.Cwd = cwd
+	// $OLDPWD and $PWD follow the directory changes, for ~- and ~+
+	s.exportVar("OLDPWD", s.Cwd)
+	s.exportVar("PWD", cwd)
+	s.Cwd = cwd
+	return 0
+}
+
+// Options known to `set -o`
+var setOptions = []string{"pipefail"}
+
+// Returns the letters of the shell's active single-letter options, as $-
+func (s *State) optionFlags() string {
+	flags := ""
+	if s.IsInteractive {
+		flags += "i"
 	}
+	if s.jobs.control {
+		flags += "m"
+	}
+	return flags
 }
 
-func (s *State) BuiltinSet(args []string) {
+func (s *State) BuiltinSet(args []string) int {
+	if len(args) > 1 && (args[1] == "-o" || args[1] == "+o") {
+		return s.setOptions(args)
+	}
 	if len(args) != 3 {
-		s.ReportError("set needs 2 arguments, got [%s]", parser.Format(args...))
-		return
+		return s.ReportCommandError("set needs 2 arguments, got [%s]", parser.Format(args...))
+	}
+	if !isName(args[1]) {
+		return s.ReportCommandError("set: `%s': not a valid identifier", args[1])
 	}
-	os.Setenv(args[1], args[2])
+	if err := s.setVar(args[1], args[2]); err != nil {
+		return s.ReportCommandError("set: %v", err)
+	}
+	return 0
 }
 
-func (s *State) BuiltinUnset(args []string) {
-	if len(args) != 2 {
-		s.ReportError("unset needs 1 argument, got [%s]", parser.Format(args...))
-		return
+// Handles `set -o name` and `set +o name`, enabling and disabling options,
+// and lists options when no name is given
+func (s *State) setOptions(args []string) int {
+	if len(args) == 2 {
+		for _, name := range setOptions {
+			if s.Options[name] {
+				fmt.Fprintf(s.stdout, "%-15s on\n", name)
+			} else {
+				fmt.Fprintf(s.stdout, "%-15s off\n", name)
+			}
+		}
+		return 0
+	}
+
+	status := 0
+	for _, name := range args[2:] {
+		known := false
+		for _, option := range setOptions {
+			known = known || option == name
+		}
+		if !known {
+			status = s.ReportCommandError("set: %s: invalid option name", name)
+			continue
+		}
+		s.Options[name] = args[1] == "-o"
+	}
+	return status
+}
+
+// Options known to `shopt`
+var shoptOptions = []string{"dotglob", "extglob", "failglob", "nocaseglob", "nullglob"}
+
+// Handles `shopt -s name` and `shopt -u name`, enabling and disabling options,
+// and prints whether options are enabled for `shopt name`, failing if one
+// isn't, or all of them without a name
+func (s *State) BuiltinShopt(args []string) int {
+	names := args[1:]
+	enable, disable := len(names) > 0 && names[0] == "-s", len(names) > 0 && names[0] == "-u"
+	if enable || disable {
+		names = names[1:]
+	}
+
+	status := 0
+	for _, name := range names {
+		known := false
+		for _, option := range shoptOptions {
+			known = known || option == name
+		}
+		if !known {
+			status = s.ReportCommandError("shopt: %s: invalid shell option name", name)
+		}
+	}
+	if status != 0 {
+		return status
+	}
+
+	if len(names) > 0 && (enable || disable) {
+		for _, name := range names {
+			s.ShellOptions[name] = enable
+		}
+		return 0
 	}
-	os.Unsetenv(args[1])
+
+	// Without names, -s and -u list the enabled and disabled options
+	listed := names
+	if len(listed) == 0 {
+		listed = shoptOptions
+	}
+	for _, name := range listed {
+		on := s.ShellOptions[name]
+		if (enable && !on) || (disable && on) {
+			continue
+		}
+		if on {
+			fmt.Fprintf(s.stdout, "%-15s on\n", name)
+		} else {
+			fmt.Fprintf(s.stdout, "%-15s off\n", name)
+			if len(names) > 0 {
+				status = 1
+			}
+		}
+	}
+	return status
 }
 
-func (s *State) BuiltinAlias(args []string) {
+func (s *State) BuiltinUnset(args []string) int {
+	if len(args) < 2 {
+		return s.ReportCommandError("unset needs at least 1 argument")
+	}
+	status := 0
+	for _, name := range args[1:] {
+		if err := s.unsetVar(name); err != nil {
+			status = s.ReportCommandError("unset: %v", err)
+		}
+	}
+	return status
+}
+
+func (s *State) BuiltinAlias(args []string) int {
+	if len(args) == 1 {
+		names := make([]string, 0, len(s.Aliases))
+		for name := range s.Aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(s.stdout, "alias %s %s\n", name, parser.Format(s.Aliases[name]))
+		}
+		return 0
+	}
+	if len(args) == 2 {
+		if value, ok := s.Aliases[args[1]]; ok {
+			fmt.Fprintf(s.stdout, "alias %s %s\n", args[1], parser.Format(value))
+			return 0
+		}
+		return s.ReportCommandError("alias %s not found", args[1])
+	}
 	if len(args) != 3 {
-		s.ReportError("alias needs 2 arguments, got [%s]", parser.Format(args...))
-		return
+		return s.ReportCommandError("alias needs 2 arguments, got [%s]", parser.Format(args...))
 	}
 	s.Aliases[args[1]] = args[2]
+	return 0
 }
 
-func (s *State) BuiltinSource(args []string) {
+func (s *State) BuiltinSource(args []string) int {
 	if len(args) != 2 {
-		s.ReportError("source needs 1 argument, got [%s]", parser.Format(args...))
-		return
+		return s.ReportCommandError("source needs 1 argument, got [%s]", parser.Format(args...))
+	}
+	s.calls++
+	status := s.ExecuteFile(args[1])
+	s.calls--
+	s.returning = false
+	return status
+}
+
+// Resolves a path relative to the shell's current directory
+func (s *State) absPath(path string) string {
+	if strings.HasPrefix(path, "/") {
+		return path
+	}
+	if path == "" {
+		return s.Cwd
 	}
-	s.ExecuteFile(args[1])
+	return s.Cwd + "/" + path
 }
 
 // Returns if a file is a directory, returning false in case of any error
@@ -428,15 +1248,17 @@ func init() {
 		os.Setenv("SHELL", ex)
 	}
 
-	// Forward signals to running commands
+	// Forward signals to the foreground job
 	sigc := make(chan os.Signal, 5)
-	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGTSTP)
 	go func() {
 		for {
 			select {
 			case s := <-sigc:
-				if currentCmd != nil {
-					currentCmd.Process.Signal(s)
+				if s == syscall.SIGTSTP {
+					// Stops running commands but not the shell
+				} else if currentState.jobs.SignalForeground(s.(syscall.Signal)) {
+					// Forwarded
 				} else if s == syscall.SIGTERM {
 					currentState.ReportError("got SIGTERM, exiting")
 					currentState.Quit(1)
@@ -462,7 +1284,6 @@ func main() {
 	}
 
 	// Handle args
-	ranFile := false
 	for i, arg := range os.Args[1:] {
 		if arg == "-v" || arg == "-V" || arg == "--version" || arg == "version" {
 			fmt.Fprintf(os.Stderr, "ush version %s\n", ushVersion)
@@ -478,33 +1299,51 @@ func main() {
 				s.ReportError("called with '-c' but missing a command")
 				return
 			}
-			s.Execute([][]string{command})
-			s.Quit(0)
+			if len(command) == 1 {
+				s.Quit(s.ExecuteLine(command[0]))
+			}
+			words := make([]parser.Word, len(command))
+			for i, arg := range command {
+				words[i] = parser.LiteralWord(arg)
+			}
+			s.Quit(s.executePipeline(&parser.Pipeline{Commands: []*parser.Command{{Args: command, Words: words}}}, false))
 			return
 		}
 		if arg[0] == '-' {
 			// ignore unknown args starting with - or --
 			continue
 		}
-		if _, err := os.Stat(arg); err == nil {
-			ranFile = true
-			s.ExecuteFile(arg)
-		} else {
+		if _, err := os.Stat(arg); err != nil {
 			s.ReportError("\"%s\" is not a file", arg)
 			return
 		}
-	}
-	if ranFile {
-		s.Quit(0) // Exit before starting interactive more if we ran a file
+		// The arguments following the script are its positional parameters
+		s.Name = arg
+		s.Positional = os.Args[i+2:]
+		s.Quit(s.ExecuteFile(arg)) // Exit before starting interactive mode
 	}
 
 	s.IsInteractive = true
+	if pgid, err := terminalPgrp(); err == nil && pgid == syscall.Getpgrp() {
+		s.jobs.control = true
+	}
 
 	// Main interactive loop
 	for {
+		s.jobs.Notify(s.stderr)
 		promptLine := filepath.Base(s.Cwd) + "$ "
-		if line, err := s.prompt.Prompt(promptLine); err == nil {
+		line, err := s.prompt.Prompt(promptLine)
+		if err == nil {
 			s.prompt.AppendHistory(line)
+			line, err = completeLine(line, func() (string, error) {
+				more, err := s.prompt.Prompt("> ")
+				if err == nil {
+					s.prompt.AppendHistory(more)
+				}
+				return more, err
+			})
+		}
+		if err == nil {
 			s.ExecuteLine(line)
 		} else if err == prompt.ErrorPromptAborted || err == prompt.ErrorPromptEnded {
 			fmt.Println()
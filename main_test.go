@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Runs a script in a new shell, returning what it wrote to stdout and its
+// exit status
+func runScript(script string) (string, int) {
+	var stdout bytes.Buffer
+	s := NewState()
+	s.stdout = &stdout
+	status := s.ExecuteLine(script)
+	return stdout.String(), status
+}
+
+func TestExecInSubshell(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+		status int
+	}{
+		{"(exec /bin/echo hi); echo after", "hi\nafter\n", 0},
+		{"(cd /tmp; exec /bin/pwd); echo after", "/tmp\nafter\n", 0},
+		{"(exec sh -c 'exit 3'; echo no)", "", 3},
+		{"(exec /nonexistent; echo no) 2>/dev/null", "", 127},
+	}
+	for _, test := range tests {
+		got, status := runScript(test.script)
+		if got != test.want || status != test.status {
+			t.Errorf("running %q wrote %q and returned %d, want %q and %d", test.script, got, status, test.want, test.status)
+		}
+	}
+}
+
+func TestExecInSubstitution(t *testing.T) {
+	got, status := runScript("x=$(exec /bin/echo sub; echo no); echo after $x")
+	if got != "after sub\n" || status != 0 {
+		t.Errorf("exec in a command substitution wrote %q and returned %d", got, status)
+	}
+	got, status = runScript("x=$(exec sh -c 'exit 4')")
+	if got != "" || status != 4 {
+		t.Errorf("failing exec in a command substitution wrote %q and returned %d", got, status)
+	}
+}
+
+func TestExecInPipeline(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{"echo hi | exec tr a-z A-Z; echo after", "HI\nafter\n"},
+		{"exec /bin/echo hi | tr a-z A-Z; echo after", "HI\nafter\n"},
+		{"{ exec /bin/echo hi; echo no; } | cat; echo after", "hi\nafter\n"},
+	}
+	for _, test := range tests {
+		if got, _ := runScript(test.script); got != test.want {
+			t.Errorf("running %q wrote %q, want %q", test.script, got, test.want)
+		}
+	}
+}
+
+func TestAutocompleteHasNoSideEffects(t *testing.T) {
+	s := NewState()
+	s.setVar("D", "/nonexistent")
+	s.defaultAutocomplete("echo ${X:=v} $(touch /nonexistent/x) ${D}/ $D/")
+	if _, ok := s.Vars["X"]; ok {
+		t.Errorf("completing ${X:=v} assigned X")
+	}
+	if got := s.expandPlainVariables("$D/${D}/${D:-x}/$(ls)/$"); got != "/nonexistent//nonexistent/${D:-x}/$(ls)/$" {
+		t.Errorf("expandPlainVariables expanded to %q", got)
+	}
+}
+
+func TestFinishedJobsArePruned(t *testing.T) {
+	var stdout bytes.Buffer
+	s := NewState()
+	s.stdout = &stdout
+	s.ExecuteLine("true & sleep 0.3; jobs")
+	if got := stdout.String(); got != "" || len(s.jobs.jobs) != 0 {
+		t.Errorf("finished job still listed: %q, %d jobs left", got, len(s.jobs.jobs))
+	}
+}
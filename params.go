@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kiasaki/ush/parser"
+)
+
+// Special parameters, expanded from `$` followed by one of these characters
+const specialParameters = "?#@*$!-"
+
+// Operators of `${NAME<op>word}`, longest first so that the first match wins
+var parameterOperators = []string{
+	":-", ":=", ":?", ":+", "##", "%%", "//", "/#", "/%",
+	"-", "=", "?", "+", "#", "%", "/",
+}
+
+// parameterError is returned by `${NAME:?message}` when NAME is unset or
+// empty, which makes non-interactive shells exit
+type parameterError struct {
+	name    string
+	message string
+}
+
+func (e *parameterError) Error() string {
+	return e.name + ": " + e.message
+}
+
+// Expands the parameters in text, like $NAME, $? or ${NAME:-default}
+func (s *State) expandVariables(text string) (string, error) {
+	parts, err := s.expandVariableParts(text)
+	if err != nil {
+		return "", err
+	}
+	return joinParts(parts), nil
+}
+
+// Expands the parameters in text like expandVariables, returning the parts of
+// the result along with their quoting: the words of `${NAME:-word}` and
+// `${NAME:+word}` can have quoted parts, which aren't split into fields
+func (s *State) expandVariableParts(text string) ([]parser.WordPart, error) {
+	parts := []parser.WordPart{}
+	for len(text) > 0 {
+		i := strings.IndexByte(text, '$')
+		if i == -1 {
+			parts = append(parts, parser.WordPart{Value: text})
+			break
+		}
+		parts = append(parts, parser.WordPart{Value: text[:i]})
+		text = text[i:]
+
+		if strings.HasPrefix(text, "${") {
+			end, err := parser.ParameterEnd(text[2:])
+			if err != nil {
+				return nil, err
+			}
+			value, err := s.expandParameter(text[2 : 2+end-1])
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, value...)
+			text = text[2+end:]
+			continue
+		}
+
+		name := parameterName(text[1:], false)
+		if name == "" {
+			parts = append(parts, parser.WordPart{Value: "$"})
+			text = text[1:]
+			continue
+		}
+		parts = append(parts, parser.WordPart{Value: s.getVar(name)})
+		text = text[1+len(name):]
+	}
+	return parts, nil
+}
+
+// Expands only the plain `$NAME` and `${NAME}` parameters in text, leaving
+// other expansions as they are since they could have side effects, like the
+// assignment of `${NAME:=word}`
+func (s *State) expandPlainVariables(text string) string {
+	var buf bytes.Buffer
+	for len(text) > 0 {
+		i := strings.IndexByte(text, '$')
+		if i == -1 {
+			buf.WriteString(text)
+			break
+		}
+		buf.WriteString(text[:i])
+		text = text[i:]
+
+		if strings.HasPrefix(text, "${") {
+			name := parameterName(text[2:], true)
+			if name != "" && strings.HasPrefix(text[2+len(name):], "}") {
+				buf.WriteString(s.getVar(name))
+				text = text[3+len(name):]
+				continue
+			}
+		} else if name := parameterName(text[1:], false); name != "" {
+			buf.WriteString(s.getVar(name))
+			text = text[1+len(name):]
+			continue
+		}
+		buf.WriteByte('$')
+		text = text[1:]
+	}
+	return buf.String()
+}
+
+// Joins the values of parts, regardless of their quoting
+func joinParts(parts []parser.WordPart) string {
+	var buf bytes.Buffer
+	for _, part := range parts {
+		buf.WriteString(part.Value)
+	}
+	return buf.String()
+}
+
+// Returns the name of the parameter text starts with: a variable name, a
+// special parameter or a positional parameter, which only has one digit
+// unless within braces
+func parameterName(text string, braced bool) string {
+	if len(text) == 0 {
+		return ""
+	}
+	if strings.IndexByte(specialParameters, text[0]) != -1 {
+		return text[:1]
+	}
+	if isDigit(text[0]) {
+		i := 1
+		for braced && i < len(text) && isDigit(text[i]) {
+			i++
+		}
+		return text[:i]
+	}
+	if !isNameStart(text[0]) {
+		return ""
+	}
+	i := 1
+	for i < len(text) && (isNameStart(text[i]) || isDigit(text[i])) {
+		i++
+	}
+	return text[:i]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Returns true if name is a valid variable name
+func isName(name string) bool {
+	return name != "" && isNameStart(name[0]) && parameterName(name, false) == name
+}
+
+// Expands the body of a `${...}` parameter expansion
+func (s *State) expandParameter(body string) ([]parser.WordPart, error) {
+	// ${#NAME} is the length of NAME's value
+	if len(body) > 1 && body[0] == '#' {
+		name, index, rest := splitParameter(body[1:])
+		if name == "" || rest != "" {
+			return nil, fmt.Errorf("${%s}: bad substitution", body)
+		}
+		if index == "@" || index == "*" {
+			return unquotedParts(strconv.Itoa(len(s.getArray(name)))), nil
+		}
+		value, _ := s.lookupParameter(name, index)
+		return unquotedParts(strconv.Itoa(utf8.RuneCountInString(value))), nil
+	}
+
+	name, index, rest := splitParameter(body)
+	if name == "" {
+		return nil, fmt.Errorf("${%s}: bad substitution", body)
+	}
+	value, set := s.lookupParameter(name, index)
+	if rest == "" {
+		return unquotedParts(value), nil
+	}
+
+	op := ""
+	for _, o := range parameterOperators {
+		if strings.HasPrefix(rest, o) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return nil, fmt.Errorf("${%s}: bad substitution", body)
+	}
+	word := rest[len(op):]
+
+	switch op {
+	case "#", "##", "%", "%%":
+		pattern, err := s.expandPattern(word)
+		if err != nil {
+			return nil, err
+		}
+		return unquotedParts(removeMatch(value, pattern, op, s.matchOptions())), nil
+	case "/", "//", "/#", "/%":
+		pattern, replacement := splitReplacement(word)
+		if pattern, err := s.expandPattern(pattern); err != nil {
+			return nil, err
+		} else if replacement, err := s.expandParameterText(replacement); err != nil {
+			return nil, err
+		} else {
+			return unquotedParts(replaceMatch(value, pattern, replacement, op, s.matchOptions())), nil
+		}
+	}
+
+	// With a colon, empty values count as unset
+	if op[0] == ':' {
+		set = set && value != ""
+		op = op[1:]
+	}
+	if op == "+" {
+		if set {
+			return s.expandParameterWord(word)
+		}
+		return nil, nil
+	}
+	if set {
+		return unquotedParts(value), nil
+	}
+	switch op {
+	case "=":
+		value, err := s.expandParameterText(word)
+		if err != nil {
+			return nil, err
+		}
+		if index != "" || !isName(name) {
+			return nil, fmt.Errorf("%s: cannot assign this way", name)
+		}
+		return unquotedParts(value), s.setVar(name, value)
+	case "?":
+		message, err := s.expandParameterText(word)
+		if err != nil {
+			return nil, err
+		}
+		if message == "" {
+			message = "parameter null or not set"
+		}
+		return nil, &parameterError{name, message}
+	}
+	return s.expandParameterWord(word)
+}
+
+// Splits the body of a `${...}` parameter expansion into the parameter's
+// name, its index between brackets if any, and what follows
+func splitParameter(body string) (name, index, rest string) {
+	name = parameterName(body, true)
+	rest = body[len(name):]
+	if strings.HasPrefix(rest, "[") {
+		if end := strings.IndexByte(rest, ']'); end != -1 {
+			index, rest = rest[1:end], rest[end+1:]
+		}
+	}
+	return
+}
+
+// Splits the pattern and replacement of `${NAME/pattern/replacement}` on the
+// first slash that isn't escaped
+func splitReplacement(word string) (pattern, replacement string) {
+	for i := 0; i < len(word); i++ {
+		if word[i] == '\\' {
+			i++
+		} else if word[i] == '/' {
+			return word[:i], word[i+1:]
+		}
+	}
+	return word, ""
+}
+
+func unquotedParts(value string) []parser.WordPart {
+	return []parser.WordPart{{Value: value}}
+}
+
+// Expands the word of `${NAME:-word}` and similar forms into parts keeping
+// its quoting, so that `${NAME:-"a b"}` stays a single field
+func (s *State) expandParameterWord(text string) ([]parser.WordPart, error) {
+	word, err := parser.ParseWord(text)
+	if err != nil {
+		return nil, err
+	}
+	parts := []parser.WordPart{}
+	for i, part := range word {
+		value := part.Value
+		switch {
+		case part.Substitution || part.Arithmetic:
+			if value, err = s.substitute(part); err != nil {
+				return nil, err
+			}
+		case part.Quoting == parser.DoubleQuoted:
+			if value, err = s.expandVariables(value); err != nil {
+				return nil, err
+			}
+		case part.Quoting == parser.Unquoted:
+			if i == 0 {
+				if dir, rest, ok := s.expandTilde(value, "/"); ok && (rest != "" || len(word) == 1) {
+					parts = append(parts, parser.WordPart{Value: dir, Quoting: parser.SingleQuoted})
+					value = rest
+				}
+			}
+			expanded, err := s.expandVariableParts(value)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, expanded...)
+			continue
+		}
+		parts = append(parts, parser.WordPart{Value: value, Quoting: part.Quoting})
+	}
+	return parts, nil
+}
+
+// Expands the word of `${NAME:=word}` and similar forms into a single string
+func (s *State) expandParameterText(text string) (string, error) {
+	parts, err := s.expandParameterWord(text)
+	if err != nil {
+		return "", err
+	}
+	return joinParts(parts), nil
+}
+
+// Expands the pattern of `${NAME#pattern}` and similar forms, escaping the
+// quoted parts of it so that they match literally
+func (s *State) expandPattern(text string) (string, error) {
+	word, err := parser.ParseWord(text)
+	if err != nil {
+		return "", err
+	}
+	return s.expandPatternWord(word)
+}
+
+// Expands a word used as a pattern, escaping its quoted parts so that they
+// match literally
+func (s *State) expandPatternWord(word parser.Word) (string, error) {
+	var err error
+	var buf bytes.Buffer
+	for _, part := range word {
+		value := part.Value
+		if part.Substitution || part.Arithmetic {
+			if value, err = s.substitute(part); err != nil {
+				return "", err
+			}
+		} else if part.Quoting != parser.SingleQuoted {
+			if value, err = s.expandVariables(value); err != nil {
+				return "", err
+			}
+		}
+		if part.Quoting != parser.Unquoted {
+			value = escapeGlob(value)
+		}
+		buf.WriteString(value)
+	}
+	return buf.String(), nil
+}
+
+// Returns the byte offsets of the start of each character of text, and of its
+// end
+func runeOffsets(text string) []int {
+	offsets := make([]int, 0, len(text)+1)
+	for i := range text {
+		offsets = append(offsets, i)
+	}
+	return append(offsets, len(text))
+}
+
+// Removes the shortest (`#` and `%`) or longest (`##` and `%%`) prefix (`#`)
+// or suffix (`%`) of value matching pattern
+func removeMatch(value, pattern, op string, options matchOptions) string {
+	offsets := runeOffsets(value)
+	for i := range offsets {
+		switch op {
+		case "#":
+			if end := offsets[i]; matchPattern(pattern, value[:end], options) {
+				return value[end:]
+			}
+		case "##":
+			if end := offsets[len(offsets)-1-i]; matchPattern(pattern, value[:end], options) {
+				return value[end:]
+			}
+		case "%":
+			if start := offsets[len(offsets)-1-i]; matchPattern(pattern, value[start:], options) {
+				return value[:start]
+			}
+		case "%%":
+			if start := offsets[i]; matchPattern(pattern, value[start:], options) {
+				return value[:start]
+			}
+		}
+	}
+	return value
+}
+
+// Replaces the first (`/`) or every (`//`) longest match of pattern in value,
+// or the longest one at its start (`/#`) or end (`/%`)
+func replaceMatch(value, pattern, replacement, op string, options matchOptions) string {
+	offsets := runeOffsets(value)
+	switch op {
+	case "/#":
+		for i := len(offsets) - 1; i >= 0; i-- {
+			if matchPattern(pattern, value[:offsets[i]], options) {
+				return replacement + value[offsets[i]:]
+			}
+		}
+		return value
+	case "/%":
+		for i := 0; i < len(offsets); i++ {
+			if matchPattern(pattern, value[offsets[i]:], options) {
+				return value[:offsets[i]] + replacement
+			}
+		}
+		return value
+	}
+
+	var buf bytes.Buffer
+	for start := 0; start < len(offsets)-1; start++ {
+		end := len(offsets) - 1
+		for end > start && !matchPattern(pattern, value[offsets[start]:offsets[end]], options) {
+			end--
+		}
+		if end == start {
+			buf.WriteString(value[offsets[start]:offsets[start+1]])
+			continue
+		}
+		buf.WriteString(replacement)
+		if op == "/" {
+			buf.WriteString(value[offsets[end]:])
+			return buf.String()
+		}
+		start = end - 1
+	}
+	return buf.String()
+}
+
+// Returns the value of a parameter, or of one of an array's values given an
+// index, along with whether it is set
+func (s *State) lookupParameter(name, index string) (string, bool) {
+	if index == "" {
+		return s.lookupVar(name)
+	}
+	values := s.getArray(name)
+	if index == "@" || index == "*" {
+		return strings.Join(values, " "), len(values) > 0
+	}
+	if i, err := strconv.Atoi(index); err == nil && i >= 0 && i < len(values) {
+		return values[i], true
+	}
+	return "", false
+}
+
+// Returns the value of a variable, handling special parameters like $? and
+// positional parameters like $1, and whether it is set
+func (s *State) lookupVar(name string) (string, bool) {
+	switch name {
+	case "?":
+		return strconv.Itoa(s.LastStatus), true
+	case "#":
+		return strconv.Itoa(len(s.Positional)), true
+	case "@", "*":
+		return strings.Join(s.Positional, " "), len(s.Positional) > 0
+	case "PIPESTATUS":
+		return s.getArray(name)[0], true
+	case "0":
+		return s.Name, true
+	case "$":
+		return strconv.Itoa(os.Getpid()), true
+	case "!":
+		return s.lastBackgroundPid()
+	case "-":
+		return s.optionFlags(), true
+	case "_":
+		return s.lastArg, true
+	}
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		if n > len(s.Positional) {
+			return "", false
+		}
+		return s.Positional[n-1], true
+	}
+	if v, ok := s.Vars[name]; ok && !v.Unset {
+		return v.Value, true
+	}
+	return "", false
+}
+
+func (s *State) getVar(name string) string {
+	value, _ := s.lookupVar(name)
+	return value
+}
+
+// Returns the values of an array variable, a plain variable being an array
+// of one value when set
+func (s *State) getArray(name string) []string {
+	if name == "@" || name == "*" {
+		return append([]string{}, s.Positional...)
+	}
+	if name == "PIPESTATUS" {
+		values := make([]string, len(s.PipeStatus))
+		for i, status := range s.PipeStatus {
+			values[i] = strconv.Itoa(status)
+		}
+		if len(values) == 0 {
+			values = append(values, "0")
+		}
+		return values
+	}
+	if value, ok := s.lookupVar(name); ok {
+		return []string{value}
+	}
+	return []string{}
+}
+
+// Finds the first "$@" or "${@}" of double-quoted text, which expand to one
+// argument per positional parameter, returning the text around it
+func splitAtPositional(text string) (before, after string, ok bool) {
+	for i := 0; i < len(text); i++ {
+		if text[i] != '$' {
+			continue
+		}
+		rest := text[i+1:]
+		if strings.HasPrefix(rest, "@") {
+			return text[:i], rest[1:], true
+		}
+		if strings.HasPrefix(rest, "{@}") {
+			return text[:i], rest[3:], true
+		}
+		if strings.HasPrefix(rest, "{") {
+			end, err := parser.ParameterEnd(rest[1:])
+			if err != nil {
+				break
+			}
+			i += 1 + end
+		}
+	}
+	return text, "", false
+}
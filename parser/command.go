@@ -0,0 +1,678 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	MissingRedirectTargetError = errors.New("Missing redirection target")
+	UnterminatedPipelineError  = errors.New("Unterminated pipeline")
+	UnterminatedListError      = errors.New("Unterminated command list")
+	UnterminatedCompoundError  = errors.New("Unterminated compound command")
+)
+
+// Reserved words that can't start a command, as they end compound commands
+var closingWords = []string{"then", "elif", "else", "fi", "do", "done", "esac", "}"}
+
+// SyntaxError is returned when an operator is found where a command is
+// expected, like in `ls | | wc` or `&& ls`
+type SyntaxError struct {
+	Token string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("Syntax error near unexpected token `%s'", strings.Replace(e.Token, "\n", "newline", -1))
+}
+
+// Redirect is a single I/O redirection attached to a command, such as
+// `2>>errors.log`, `2>&1` or `<<EOF`
+type Redirect struct {
+	Fd     int    // file descriptor being redirected
+	Op     string // one of ">", ">>", ">&", "&>", "&>>", "<", "<<", "<<-" or "<<<"
+	Target string // file name, file descriptor number for ">&", here-document delimiter or here-string
+	Body   string // here-document contents
+	Quoted bool   // true when the here-document delimiter was quoted, disabling expansion
+
+	TargetWord Word // parts of the target, for expansion
+}
+
+// Command is a single stage of a pipeline. Words holds the parts of each of
+// the Args, for expansion. Compound commands have no Args, but their
+// redirections apply to the whole of them.
+type Command struct {
+	Assignments []*Assignment // `NAME=value` words preceding the command's arguments
+	Args        []string
+	Words       []Word
+	Redirects   []*Redirect
+	Compound    Compound // set for compound commands, like `if` or `while`
+}
+
+// Assignment is a `NAME=value` word, setting a variable for the shell, or
+// only for the command it precedes
+type Assignment struct {
+	Name  string
+	Value string
+
+	ValueWord Word // parts of the value, for expansion
+}
+
+// Compound is a command other than a simple one, like `if`, `while`, a
+// function definition or `((...))`
+type Compound interface {
+	String() string
+}
+
+// IfClause is an `if` command, running the body following the first of its
+// conditions to succeed, or its else body if none does
+type IfClause struct {
+	Conditions []*List
+	Bodies     []*List
+	Else       *List // nil without an else body
+}
+
+// WhileLoop is a `while` loop, running its body for as long as its condition
+// succeeds, or an `until` loop, running it for as long as it fails
+type WhileLoop struct {
+	Until     bool
+	Condition *List
+	Body      *List
+}
+
+// ForLoop is a `for` loop, running its body with a variable set to each of
+// its words in turn, once expanded. Without `in`, Words is nil and the loop
+// goes over the positional parameters.
+type ForLoop struct {
+	Name  string
+	Words []Word
+	Body  *List
+}
+
+// CaseClause is a `case` command, running the body of the first of its items
+// with a pattern matching its word
+type CaseClause struct {
+	Word  Word
+	Items []*CaseItem
+}
+
+// CaseItem is a `pattern | pattern) body ;;` item of a case command, Body
+// being empty when there is nothing to run
+type CaseItem struct {
+	Patterns []Word
+	Body     *List
+}
+
+// FunctionDef is a `name() { body; }` command, defining a function. A
+// `name() ( body )` function's Body is made of a Subshell.
+type FunctionDef struct {
+	Name string
+	Body *List
+}
+
+// Subshell is a `( body )` command, running its body in a copy of the shell
+// whose changes are discarded once it is done
+type Subshell struct {
+	Body *List
+}
+
+// BraceGroup is a `{ body; }` command, running its body in the shell itself
+// as a single command, for redirections and pipelines
+type BraceGroup struct {
+	Body *List
+}
+
+// ArithmeticCommand is a `((...))` command, which succeeds when its expression
+// isn't zero
+type ArithmeticCommand struct {
+	Expression string
+}
+
+func (c *Command) empty() bool {
+	return len(c.Assignments) == 0 && len(c.Args) == 0 && len(c.Redirects) == 0 && c.Compound == nil
+}
+
+// Pipeline is a list of commands, each one's output piped into the next one
+type Pipeline struct {
+	Commands []*Command
+	Negated  bool // true when preceded by `!`, inverting the pipeline's status
+}
+
+// List is a sequence of pipelines, Operators[i] being the operator following
+// Pipelines[i], one of ";", "&", "&&" or "||". A `&` applies to all the
+// pipelines joined by `&&` and `||` preceding it, they run in the background.
+type List struct {
+	Pipelines []*Pipeline
+	Operators []string
+}
+
+// ParseList parses input into a list of pipelines separated by `;`, `&`,
+// `&&`, `||` or newlines, along with their redirections. Redirections can appear
+// anywhere within a command, `>out echo hi` is the same as `echo hi >out`.
+// Compound commands, like `if`, can span several lines.
+func ParseList(input string) (*List, error) {
+	tokens, err := Parse(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &tokenParser{tokens: tokens}
+	list, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, &SyntaxError{p.peek().Value}
+	}
+	return list, nil
+}
+
+// Parses a list up to the end of the input, up to one of the given reserved
+// words starting a command, or up to an operator ending lists, like `;;` or
+// `)`
+func (p *tokenParser) parseList(terminators ...string) (*List, error) {
+	list := &List{}
+	for {
+		p.skipNewlines()
+		if p.done() || p.peekWord(terminators...) || p.peekListEnd() {
+			return list, nil
+		}
+
+		pipeline, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		op := ";"
+		if !p.done() && isListOperator(p.peek()) {
+			op = p.next().Value
+		} else if !p.done() && p.peek().Value != "\n" && !p.peekListEnd() {
+			return nil, &SyntaxError{p.peek().Value}
+		}
+		list.Pipelines = append(list.Pipelines, pipeline)
+		list.Operators = append(list.Operators, op)
+
+		if op == "&&" || op == "||" {
+			p.skipNewlines()
+			if p.done() {
+				return nil, UnterminatedListError
+			}
+		}
+	}
+}
+
+// Parses the non-empty list of a compound command, which has to be followed
+// by one of the given reserved words
+func (p *tokenParser) parseCompoundList(terminators ...string) (*List, error) {
+	list, err := p.parseList(terminators...)
+	if err != nil {
+		return nil, err
+	}
+	if p.done() {
+		return nil, UnterminatedCompoundError
+	}
+	if len(list.Pipelines) == 0 || !p.peekWord(terminators...) {
+		return nil, &SyntaxError{p.peek().Value}
+	}
+	return list, nil
+}
+
+func isListOperator(token Token) bool {
+	switch token.Value {
+	case ";", "&", "&&", "||":
+		return token.Type == OperatorToken
+	}
+	return false
+}
+
+// Returns true if the next token ends the list being parsed, like the `;;`
+// ending the items of a case
+func (p *tokenParser) peekListEnd() bool {
+	token := p.peek()
+	return token.Type == OperatorToken && (token.Value == ";;" || token.Value == ")")
+}
+
+type tokenParser struct {
+	tokens []Token
+	pos    int
+}
+
+func (p *tokenParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *tokenParser) peek() Token {
+	return p.tokens[p.pos]
+}
+
+func (p *tokenParser) next() Token {
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+func (p *tokenParser) skipNewlines() {
+	for !p.done() && p.peek().Type == OperatorToken && p.peek().Value == "\n" {
+		p.pos++
+	}
+}
+
+// Returns true if the next token is the given operator
+func (p *tokenParser) peekOperator(op string) bool {
+	return !p.done() && p.peek().Type == OperatorToken && p.peek().Value == op
+}
+
+// Returns true if the next token is one of the given unquoted words
+func (p *tokenParser) peekWord(words ...string) bool {
+	if p.done() {
+		return false
+	}
+	token := p.peek()
+	if token.Type != WordToken || token.Quoted {
+		return false
+	}
+	for _, word := range words {
+		if token.Value == word {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *tokenParser) parsePipeline() (*Pipeline, error) {
+	pipeline := &Pipeline{}
+	if p.peekWord("!") {
+		pipeline.Negated = true
+		p.pos++
+	}
+
+	for {
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		pipeline.Commands = append(pipeline.Commands, cmd)
+		if p.done() || p.peek().Type != OperatorToken || p.peek().Value != "|" {
+			return pipeline, nil
+		}
+		p.pos++
+		p.skipNewlines()
+		if p.done() {
+			return nil, UnterminatedPipelineError
+		}
+	}
+}
+
+// Parses a single stage of a pipeline, a simple or compound command along
+// with its redirections
+func (p *tokenParser) parseCommand() (*Command, error) {
+	cmd := &Command{}
+	if p.peekWord(closingWords...) {
+		return nil, &SyntaxError{p.peek().Value}
+	}
+	var err error
+	if p.peekWord("if") {
+		cmd.Compound, err = p.parseIf()
+	} else if p.peekWord("while", "until") {
+		cmd.Compound, err = p.parseWhile()
+	} else if p.peekWord("for") {
+		cmd.Compound, err = p.parseFor()
+	} else if p.peekWord("case") {
+		cmd.Compound, err = p.parseCase()
+	} else if p.peekWord("function") || p.peekFunction() {
+		cmd.Compound, err = p.parseFunction()
+	} else if p.peekWord("{") {
+		cmd.Compound, err = p.parseBraceGroup()
+	} else if p.peekOperator("(") {
+		cmd.Compound, err = p.parseSubshell()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for !p.done() {
+		token := p.peek()
+		if token.Type == ArithmeticToken {
+			if len(cmd.Args) > 0 || cmd.Compound != nil {
+				return nil, &SyntaxError{"(("}
+			}
+			cmd.Compound = &ArithmeticCommand{Expression: token.Value}
+			p.pos++
+		} else if token.Type == WordToken {
+			if cmd.Compound != nil {
+				return nil, &SyntaxError{token.Value}
+			}
+			if assignment := newAssignment(token); assignment != nil && len(cmd.Args) == 0 {
+				cmd.Assignments = append(cmd.Assignments, assignment)
+			} else {
+				cmd.Args = append(cmd.Args, token.Value)
+				cmd.Words = append(cmd.Words, token.Word)
+			}
+			p.pos++
+		} else if isRedirectOperator(token.Value) {
+			p.pos++
+			if p.done() || p.peek().Type != WordToken {
+				return nil, MissingRedirectTargetError
+			}
+			target := p.next()
+			redirect := newRedirect(token.Value, target.Value)
+			redirect.Body = token.HereDoc
+			redirect.Quoted = target.Quoted
+			redirect.TargetWord = target.Word
+			cmd.Redirects = append(cmd.Redirects, redirect)
+		} else {
+			break
+		}
+	}
+
+	if cmd.empty() {
+		if p.done() {
+			return nil, &SyntaxError{"\n"}
+		}
+		return nil, &SyntaxError{p.peek().Value}
+	}
+
+	return cmd, nil
+}
+
+// Returns the assignment a `NAME=value` word stands for, nil for other words
+func newAssignment(token Token) *Assignment {
+	if len(token.Word) == 0 {
+		return nil
+	}
+	first := token.Word[0]
+	if first.Quoting != Unquoted || first.Substitution || first.Arithmetic {
+		return nil
+	}
+	i := strings.IndexByte(first.Value, '=')
+	if i == -1 || !isName(first.Value[:i]) {
+		return nil
+	}
+	value := Word{}
+	if rest := first.Value[i+1:]; rest != "" {
+		value = append(value, WordPart{Value: rest})
+	}
+	value = append(value, token.Word[1:]...)
+	return &Assignment{Name: first.Value[:i], Value: token.Value[i+1:], ValueWord: value}
+}
+
+// Parses an `if` command, from its `if` to its `fi`
+func (p *tokenParser) parseIf() (*IfClause, error) {
+	clause := &IfClause{}
+	p.pos++
+	for {
+		condition, err := p.parseCompoundList("then")
+		if err != nil {
+			return nil, err
+		}
+		if !p.peekWord("then") {
+			return nil, &SyntaxError{p.peek().Value}
+		}
+		p.pos++
+		body, err := p.parseCompoundList("elif", "else", "fi")
+		if err != nil {
+			return nil, err
+		}
+		clause.Conditions = append(clause.Conditions, condition)
+		clause.Bodies = append(clause.Bodies, body)
+
+		switch p.next().Value {
+		case "else":
+			if clause.Else, err = p.parseCompoundList("fi"); err != nil {
+				return nil, err
+			}
+			p.pos++
+			return clause, nil
+		case "fi":
+			return clause, nil
+		}
+	}
+}
+
+// Parses a `while` or `until` loop
+func (p *tokenParser) parseWhile() (*WhileLoop, error) {
+	loop := &WhileLoop{Until: p.next().Value == "until"}
+	var err error
+	if loop.Condition, err = p.parseCompoundList("do"); err != nil {
+		return nil, err
+	}
+	if loop.Body, err = p.parseDoGroup(); err != nil {
+		return nil, err
+	}
+	return loop, nil
+}
+
+// Parses a `for name in words; do ...; done` loop, `in words` being optional
+func (p *tokenParser) parseFor() (*ForLoop, error) {
+	p.pos++
+	if p.done() {
+		return nil, UnterminatedCompoundError
+	}
+	name := p.next()
+	if name.Type != WordToken || name.Quoted || !isName(name.Value) {
+		return nil, &SyntaxError{name.Value}
+	}
+	loop := &ForLoop{Name: name.Value}
+
+	p.skipNewlines()
+	if p.peekWord("in") {
+		p.pos++
+		loop.Words = []Word{}
+		for !p.done() && p.peek().Type == WordToken {
+			loop.Words = append(loop.Words, p.next().Word)
+		}
+		if p.done() {
+			return nil, UnterminatedCompoundError
+		}
+		if op := p.next().Value; op != ";" && op != "\n" {
+			return nil, &SyntaxError{op}
+		}
+	} else if !p.done() && p.peek().Type == OperatorToken && p.peek().Value == ";" {
+		p.pos++
+	}
+
+	var err error
+	if loop.Body, err = p.parseDoGroup(); err != nil {
+		return nil, err
+	}
+	return loop, nil
+}
+
+// Parses the `do ... done` body of a loop
+func (p *tokenParser) parseDoGroup() (*List, error) {
+	p.skipNewlines()
+	if p.done() {
+		return nil, UnterminatedCompoundError
+	}
+	if !p.peekWord("do") {
+		return nil, &SyntaxError{p.peek().Value}
+	}
+	p.pos++
+	body, err := p.parseCompoundList("done")
+	if err != nil {
+		return nil, err
+	}
+	p.pos++
+	return body, nil
+}
+
+// Parses a `case word in pattern) body ;; esac` command
+func (p *tokenParser) parseCase() (*CaseClause, error) {
+	p.pos++
+	if p.done() {
+		return nil, UnterminatedCompoundError
+	}
+	word := p.next()
+	if word.Type != WordToken {
+		return nil, &SyntaxError{word.Value}
+	}
+	clause := &CaseClause{Word: word.Word}
+	p.skipNewlines()
+	if p.done() {
+		return nil, UnterminatedCompoundError
+	}
+	if !p.peekWord("in") {
+		return nil, &SyntaxError{p.peek().Value}
+	}
+	p.pos++
+
+	for {
+		p.skipNewlines()
+		if p.done() {
+			return nil, UnterminatedCompoundError
+		}
+		if p.peekWord("esac") {
+			p.pos++
+			return clause, nil
+		}
+
+		item := &CaseItem{}
+		if token := p.peek(); token.Type == OperatorToken && token.Value == "(" {
+			p.pos++
+		}
+		for {
+			if p.done() {
+				return nil, UnterminatedCompoundError
+			}
+			pattern := p.next()
+			if pattern.Type != WordToken {
+				return nil, &SyntaxError{pattern.Value}
+			}
+			item.Patterns = append(item.Patterns, pattern.Word)
+			if p.done() {
+				return nil, UnterminatedCompoundError
+			}
+			if op := p.next(); op.Value == ")" {
+				break
+			} else if op.Value != "|" {
+				return nil, &SyntaxError{op.Value}
+			}
+		}
+
+		var err error
+		if item.Body, err = p.parseList("esac"); err != nil {
+			return nil, err
+		}
+		clause.Items = append(clause.Items, item)
+		if p.done() {
+			return nil, UnterminatedCompoundError
+		}
+		if p.peek().Type == OperatorToken && p.peek().Value == ";;" {
+			p.pos++
+		} else if !p.peekWord("esac") {
+			return nil, &SyntaxError{p.peek().Value}
+		}
+	}
+}
+
+// Returns true if the next tokens are the `name()` starting a function
+// definition
+func (p *tokenParser) peekFunction() bool {
+	if p.pos+2 >= len(p.tokens) {
+		return false
+	}
+	name, open, close := p.tokens[p.pos], p.tokens[p.pos+1], p.tokens[p.pos+2]
+	return name.Type == WordToken && !name.Quoted &&
+		open.Type == OperatorToken && open.Value == "(" &&
+		close.Type == OperatorToken && close.Value == ")"
+}
+
+// Parses a `name() { body; }` function definition, which can also be written
+// as `function name { body; }`
+func (p *tokenParser) parseFunction() (*FunctionDef, error) {
+	if p.peekWord("function") {
+		p.pos++
+	}
+	if p.done() {
+		return nil, UnterminatedCompoundError
+	}
+	name := p.next()
+	if name.Type != WordToken || name.Quoted {
+		return nil, &SyntaxError{name.Value}
+	}
+	if p.peekOperator("(") {
+		p.pos++
+		if p.done() {
+			return nil, UnterminatedCompoundError
+		}
+		if token := p.next(); token.Type != OperatorToken || token.Value != ")" {
+			return nil, &SyntaxError{token.Value}
+		}
+	}
+
+	p.skipNewlines()
+	if p.done() {
+		return nil, UnterminatedCompoundError
+	}
+	if p.peekOperator("(") {
+		subshell, err := p.parseSubshell()
+		if err != nil {
+			return nil, err
+		}
+		body := &List{
+			Pipelines: []*Pipeline{{Commands: []*Command{{Compound: subshell}}}},
+			Operators: []string{";"},
+		}
+		return &FunctionDef{Name: name.Value, Body: body}, nil
+	}
+	if !p.peekWord("{") {
+		return nil, &SyntaxError{p.peek().Value}
+	}
+	group, err := p.parseBraceGroup()
+	if err != nil {
+		return nil, err
+	}
+	return &FunctionDef{Name: name.Value, Body: group.Body}, nil
+}
+
+// Parses a `{ body; }` brace group
+func (p *tokenParser) parseBraceGroup() (*BraceGroup, error) {
+	p.pos++
+	body, err := p.parseCompoundList("}")
+	if err != nil {
+		return nil, err
+	}
+	p.pos++
+	return &BraceGroup{Body: body}, nil
+}
+
+// Parses a `( body )` subshell
+func (p *tokenParser) parseSubshell() (*Subshell, error) {
+	p.pos++
+	body, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if p.done() {
+		return nil, UnterminatedCompoundError
+	}
+	if len(body.Pipelines) == 0 || !p.peekOperator(")") {
+		return nil, &SyntaxError{p.peek().Value}
+	}
+	p.pos++
+	return &Subshell{Body: body}, nil
+}
+
+// Returns true if name is a valid variable name
+func isName(name string) bool {
+	for i, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func isRedirectOperator(op string) bool {
+	return strings.ContainsAny(op, "<>")
+}
+
+func newRedirect(op, target string) *Redirect {
+	r := &Redirect{Fd: 1, Op: strings.TrimLeft(op, "0123456789"), Target: target}
+	if r.Op[0] == '<' {
+		r.Fd = 0
+	}
+	if fd := op[:len(op)-len(r.Op)]; fd != "" {
+		r.Fd, _ = strconv.Atoi(fd)
+	}
+	return r
+}
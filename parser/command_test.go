@@ -0,0 +1,206 @@
+package parser
+
+import "testing"
+
+// parseTest is an input to ParseList along with the list it parses to, as
+// formatted back by String, or the error it fails with
+type parseTest struct {
+	input      string
+	want       string
+	err        string
+	incomplete bool // the error is one reading more lines might fix
+}
+
+func testParseList(t *testing.T, tests []parseTest) {
+	for _, test := range tests {
+		list, err := ParseList(test.input)
+		switch {
+		case err != nil && test.err == "":
+			t.Errorf("ParseList(%q) failed: %v", test.input, err)
+		case err != nil && (err.Error() != test.err || IsIncomplete(err) != test.incomplete):
+			t.Errorf("ParseList(%q) failed with %q (incomplete: %v), want %q (incomplete: %v)",
+				test.input, err, IsIncomplete(err), test.err, test.incomplete)
+		case err == nil && test.err != "":
+			t.Errorf("ParseList(%q) = %q, want error %q", test.input, list.String(), test.err)
+		case err == nil && list.String() != test.want:
+			t.Errorf("ParseList(%q) = %q, want %q", test.input, list.String(), test.want)
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	testParseList(t, []parseTest{
+		{input: "a", want: "a"},
+		{input: "a; b", want: "a; b"},
+		{input: "a;", want: "a"},
+		{input: "a\nb", want: "a; b"},
+		{input: "\n\na\n\n", want: "a"},
+		{input: "a && b || c", want: "a && b || c"},
+		{input: "a &&\nb ||\n\nc", want: "a && b || c"},
+		{input: "a & b", want: "a & b"},
+		{input: "a &", want: "a &"},
+		{input: "a && b &", want: "a && b &"},
+		{input: "a | b | c", want: "a | b | c"},
+		{input: "a |\nb", want: "a | b"},
+		{input: "! a | b", want: "! a | b"},
+		{input: "! a && ! b", want: "! a && ! b"},
+		{input: "a > f < g 2>&1 >> h", want: "a >f <g 2>&1 >>h"},
+		{input: "x=1 y=2", want: "x=1 y=2"},
+		{input: "x=1 cmd y=2", want: "x=1 cmd y=2"},
+		{input: "a # comment && b", want: "a"},
+
+		{input: "a &&", err: "Unterminated command list", incomplete: true},
+		{input: "a ||", err: "Unterminated command list", incomplete: true},
+		{input: "a |", err: "Unterminated pipeline", incomplete: true},
+		{input: "a 'b", err: "Unterminated single-quoted string", incomplete: true},
+		{input: "a \"b", err: "Unterminated double-quoted string", incomplete: true},
+		{input: "a $(b", err: "Unterminated command substitution", incomplete: true},
+		{input: "a $((1 +", err: "Unterminated arithmetic expression", incomplete: true},
+		{input: "a ${b", err: "Unterminated parameter expansion", incomplete: true},
+		{input: "a \\", err: "Unterminated backslash-escape", incomplete: true},
+		{input: "cat <<EOF\nline", err: "Unterminated here-document", incomplete: true},
+
+		{input: "&& a", err: "Syntax error near unexpected token `&&'"},
+		{input: "a || || b", err: "Syntax error near unexpected token `||'"},
+		{input: "a | | b", err: "Syntax error near unexpected token `|'"},
+		{input: "a ;; b", err: "Syntax error near unexpected token `;;'"},
+		{input: ";", err: "Syntax error near unexpected token `;'"},
+		{input: "a; ; b", err: "Syntax error near unexpected token `;'"},
+		{input: "a & & b", err: "Syntax error near unexpected token `&'"},
+		{input: "a >", err: "Missing redirection target"},
+		{input: "a > | b", err: "Missing redirection target"},
+	})
+}
+
+func TestParseIf(t *testing.T) {
+	testParseList(t, []parseTest{
+		{input: "if a; then b; fi", want: "if a; then b; fi"},
+		{input: "if a\nthen\nb\nfi", want: "if a; then b; fi"},
+		{input: "if a; then b; elif c; then d; else e; fi", want: "if a; then b; elif c; then d; else e; fi"},
+		{input: "if a && b; then c | d; fi && e", want: "if a && b; then c | d; fi && e"},
+		{input: "if a; then b; fi > out", want: "if a; then b; fi >out"},
+		{input: "if a; then if b; then c; fi; fi", want: "if a; then if b; then c; fi; fi"},
+		{input: "if a & then b & fi", want: "if a & then b & fi"},
+		{input: "echo if then fi", want: "echo if then fi"},
+
+		{input: "if a", err: "Unterminated compound command", incomplete: true},
+		{input: "if a; then", err: "Unterminated compound command", incomplete: true},
+		{input: "if a; then b", err: "Unterminated compound command", incomplete: true},
+		{input: "if a; then b; else", err: "Unterminated compound command", incomplete: true},
+		{input: "if a; then b; elif c", err: "Unterminated compound command", incomplete: true},
+
+		{input: "if a; fi", err: "Syntax error near unexpected token `fi'"},
+		{input: "if; then b; fi", err: "Syntax error near unexpected token `;'"},
+		{input: "if a; then; fi", err: "Syntax error near unexpected token `;'"},
+		{input: "if a; then b; else; fi", err: "Syntax error near unexpected token `;'"},
+		{input: "if a; then b; fi c", err: "Syntax error near unexpected token `c'"},
+		{input: "then b", err: "Syntax error near unexpected token `then'"},
+		{input: "a; fi", err: "Syntax error near unexpected token `fi'"},
+		{input: "else", err: "Syntax error near unexpected token `else'"},
+	})
+}
+
+func TestParseLoops(t *testing.T) {
+	testParseList(t, []parseTest{
+		{input: "while a; do b; done", want: "while a; do b; done"},
+		{input: "until a; do b; done", want: "until a; do b; done"},
+		{input: "while a\ndo\nb\ndone", want: "while a; do b; done"},
+		{input: "while a | b; do c && break; done > out", want: "while a | b; do c && break; done >out"},
+		{input: "while a; do while b; do c; done; done", want: "while a; do while b; do c; done; done"},
+		{input: "for i in a b; do c $i; done", want: "for i in a b; do c $i; done"},
+		{input: "for i; do c; done", want: "for i; do c; done"},
+		{input: "for i\ndo c\ndone", want: "for i; do c; done"},
+		{input: "for i in\ndo c; done", want: "for i in; do c; done"},
+		{input: `for i in $x "a b" "$y" *.go 'c d'; do e; done`, want: `for i in $x "a b" "$y" *.go 'c d'; do e; done`},
+
+		{input: "while a", err: "Unterminated compound command", incomplete: true},
+		{input: "while a; do", err: "Unterminated compound command", incomplete: true},
+		{input: "while a; do b", err: "Unterminated compound command", incomplete: true},
+		{input: "for", err: "Unterminated compound command", incomplete: true},
+		{input: "for i in a b", err: "Unterminated compound command", incomplete: true},
+		{input: "for i in a b; do", err: "Unterminated compound command", incomplete: true},
+
+		{input: "while a; done", err: "Syntax error near unexpected token `done'"},
+		{input: "while a; do; done", err: "Syntax error near unexpected token `;'"},
+		{input: "for 1 in a; do b; done", err: "Syntax error near unexpected token `1'"},
+		{input: "for i a; do b; done", err: "Syntax error near unexpected token `a'"},
+		{input: "for i in a b | c; do d; done", err: "Syntax error near unexpected token `|'"},
+		{input: "do b; done", err: "Syntax error near unexpected token `do'"},
+		{input: "done", err: "Syntax error near unexpected token `done'"},
+	})
+}
+
+func TestParseCase(t *testing.T) {
+	testParseList(t, []parseTest{
+		{input: "case $x in a) b;; c | d) e; f;; *) ;; esac", want: "case $x in a) b ;; c | d) e; f ;; *) ;; esac"},
+		{input: "case \"$x\" in\na)\nb\n;;\nesac", want: `case "$x" in a) b ;; esac`},
+		{input: "case x in (a) b;; esac", want: "case x in a) b ;; esac"},
+		{input: "case x in a) b; esac", want: "case x in a) b ;; esac"},
+		{input: "case x in esac", want: "case x in esac"},
+		{input: `case x in "*") a;; '?' | \[) b;; esac`, want: `case x in "*") a ;; \? | \[) b ;; esac`},
+		{input: "case x in a) case y in b) c;; esac;; esac | d", want: "case x in a) case y in b) c ;; esac ;; esac | d"},
+		{input: "case in in in) in;; esac", want: "case in in in) in ;; esac"},
+
+		{input: "case", err: "Unterminated compound command", incomplete: true},
+		{input: "case x in", err: "Unterminated compound command", incomplete: true},
+		{input: "case x in a) b", err: "Unterminated compound command", incomplete: true},
+		{input: "case x in a) b;; c) d", err: "Unterminated compound command", incomplete: true},
+
+		{input: "case x a) b;; esac", err: "Syntax error near unexpected token `a'"},
+		{input: "case x in a b) c;; esac", err: "Syntax error near unexpected token `b'"},
+		{input: "case x in a) b;; esac c", err: "Syntax error near unexpected token `c'"},
+		{input: "esac", err: "Syntax error near unexpected token `esac'"},
+	})
+}
+
+func TestParseFunction(t *testing.T) {
+	testParseList(t, []parseTest{
+		{input: "f() { a; b; }", want: "f() { a; b; }"},
+		{input: "f () { a; }", want: "f() { a; }"},
+		{input: "function f { a; }", want: "f() { a; }"},
+		{input: "function f() { a; }", want: "f() { a; }"},
+		{input: "f() {\na\nb\n}", want: "f() { a; b; }"},
+		{input: "f()\n{ a; }", want: "f() { a; }"},
+		{input: "f() { g() { a; }; }; f", want: "f() { g() { a; }; }; f"},
+		{input: `f() { echo "$1" ${x:-"a b"}; }`, want: `f() { echo "$1" ${x:-"a b"}; }`},
+
+		{input: "f() {", err: "Unterminated compound command", incomplete: true},
+		{input: "f() { a", err: "Unterminated compound command", incomplete: true},
+		{input: "function", err: "Unterminated compound command", incomplete: true},
+
+		{input: "f() a", err: "Syntax error near unexpected token `a'"},
+		{input: "f() { }", err: "Syntax error near unexpected token `}'"},
+		{input: "f() { a; } b", err: "Syntax error near unexpected token `b'"},
+		{input: "function 'f' { a; }", err: "Syntax error near unexpected token `f'"},
+	})
+}
+
+func TestParseGroups(t *testing.T) {
+	testParseList(t, []parseTest{
+		{input: "( a; b )", want: "(a; b)"},
+		{input: "(a)", want: "(a)"},
+		{input: "(a\nb\n)", want: "(a; b)"},
+		{input: "( a; b ) | c > out", want: "(a; b) | c >out"},
+		{input: "(a) && (b) &", want: "(a) && (b) &"},
+		{input: "((a); b)", want: "((a); b)"},
+		{input: "{ a; b; }", want: "{ a; b; }"},
+		{input: "{ a\nb\n}", want: "{ a; b; }"},
+		{input: "{ a; b; } > out | c", want: "{ a; b; } >out | c"},
+		{input: "{ a; }; b", want: "{ a; }; b"},
+		{input: "{ (a; b); }", want: "{ (a; b); }"},
+		{input: "echo { }", want: "echo { }"},
+
+		{input: "( a", err: "Unterminated compound command", incomplete: true},
+		{input: "( a;", err: "Unterminated compound command", incomplete: true},
+		{input: "{ a", err: "Unterminated compound command", incomplete: true},
+		{input: "{ a; b", err: "Unterminated compound command", incomplete: true},
+
+		{input: "( )", err: "Syntax error near unexpected token `)'"},
+		{input: "{ }", err: "Syntax error near unexpected token `}'"},
+		{input: "(a) b", err: "Syntax error near unexpected token `b'"},
+		{input: "{ a; } b", err: "Syntax error near unexpected token `b'"},
+		{input: "a (b)", err: "Syntax error near unexpected token `('"},
+		{input: ")", err: "Syntax error near unexpected token `)'"},
+		{input: "}", err: "Syntax error near unexpected token `}'"},
+	})
+}
@@ -2,7 +2,10 @@ package parser
 
 import (
 	"bytes"
+	"fmt"
+	"strconv"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -23,7 +26,7 @@ func Format(args ...string) string {
 const (
 	specialChars      = "\\'\"`${[|&;<>()*?!"
 	extraSpecialChars = " \t\n"
-	prefixChars       = "~"
+	prefixChars       = "~#"
 )
 
 func format(word string, buf *bytes.Buffer) {
@@ -41,6 +44,11 @@ func format(word string, buf *bytes.Buffer) {
 		buf.WriteString("''")
 		return
 	}
+	if !utf8.ValidString(word) || strings.IndexFunc(word, isNonPrintable) != -1 {
+		// only $'...' can hold these and keep them readable
+		formatANSI(word, buf)
+		return
+	}
 
 	cur, prev := word, word
 	atStart := true
@@ -100,3 +108,251 @@ quote:
 		buf.WriteByte('\'')
 	}
 }
+
+func isNonPrintable(r rune) bool {
+	return r != ' ' && !unicode.IsPrint(r)
+}
+
+// Escapes of `$'...'` strings for the characters they stand for
+var ansiFormatEscapes = map[rune]string{
+	'\a': `\a`, '\b': `\b`, 0x1b: `\E`, '\f': `\f`, '\n': `\n`, '\r': `\r`,
+	'\t': `\t`, '\v': `\v`, '\\': `\\`, '\'': `\'`,
+}
+
+// formatANSI quotes a word as a `$'...'` string, backslash-escaping the
+// characters that aren't printable and the bytes that aren't valid UTF-8
+func formatANSI(word string, buf *bytes.Buffer) {
+	buf.WriteString("$'")
+	for len(word) > 0 {
+		r, l := utf8.DecodeRuneInString(word)
+		if escape, ok := ansiFormatEscapes[r]; ok {
+			buf.WriteString(escape)
+		} else if r == utf8.RuneError && l == 1 {
+			fmt.Fprintf(buf, "\\x%02x", word[0])
+		} else if !isNonPrintable(r) {
+			buf.WriteRune(r)
+		} else if r < 0x80 {
+			fmt.Fprintf(buf, "\\x%02x", r)
+		} else if r < 0x10000 {
+			fmt.Fprintf(buf, "\\u%04x", r)
+		} else {
+			fmt.Fprintf(buf, "\\U%08x", r)
+		}
+		word = word[l:]
+	}
+	buf.WriteByte('\'')
+}
+
+// String formats the redirection back into shell syntax, leaving out the
+// contents of here-documents
+func (r *Redirect) String() string {
+	fd := ""
+	if (r.Op[0] == '<' && r.Fd != 0) || (r.Op[0] == '>' && r.Fd != 1) {
+		fd = strconv.Itoa(r.Fd)
+	}
+	return fd + r.Op + Format(r.Target)
+}
+
+// String formats the assignment back into shell syntax, as written when not
+// expanded yet
+func (a *Assignment) String() string {
+	if a.ValueWord != nil {
+		return a.Name + "=" + formatWord(a.ValueWord)
+	}
+	if a.Value == "" {
+		return a.Name + "="
+	}
+	return a.Name + "=" + Format(a.Value)
+}
+
+// formatWord formats a word that wasn't expanded yet back into shell syntax,
+// keeping its expansions and the quotes around them
+func formatWord(word Word) string {
+	var buf bytes.Buffer
+	inQuote := false
+	for i, part := range word {
+		if quoted := part.Quoting == DoubleQuoted; quoted != inQuote {
+			buf.WriteByte('"')
+			inQuote = quoted
+		}
+		switch {
+		case part.Arithmetic:
+			buf.WriteString("$((" + part.Value + "))")
+		case part.Substitution:
+			buf.WriteString("$(" + part.Value + ")")
+		case part.Quoting == SingleQuoted:
+			if part.Value != "" || len(word) == 1 {
+				format(part.Value, &buf)
+			}
+		default:
+			buf.WriteString(part.Value)
+		}
+		if inQuote && i == len(word)-1 {
+			buf.WriteByte('"')
+		}
+	}
+	return buf.String()
+}
+
+// String formats the command back into shell syntax
+func (c *Command) String() string {
+	var buf bytes.Buffer
+	for _, a := range c.Assignments {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(a.String())
+	}
+	if c.Compound != nil {
+		buf.WriteString(c.Compound.String())
+	} else if len(c.Args) > 0 {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		if c.Words != nil {
+			// Not expanded yet, the words are shown as written
+			for i, word := range c.Words {
+				if i > 0 {
+					buf.WriteByte(' ')
+				}
+				buf.WriteString(formatWord(word))
+			}
+		} else {
+			buf.WriteString(Format(c.Args...))
+		}
+	}
+	for _, r := range c.Redirects {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(r.String())
+	}
+	return buf.String()
+}
+
+// String formats the command back into shell syntax
+func (c *IfClause) String() string {
+	var buf bytes.Buffer
+	for i, condition := range c.Conditions {
+		if i == 0 {
+			buf.WriteString("if ")
+		} else {
+			buf.WriteString("elif ")
+		}
+		buf.WriteString(condition.terminated())
+		buf.WriteString("then ")
+		buf.WriteString(c.Bodies[i].terminated())
+	}
+	if c.Else != nil {
+		buf.WriteString("else ")
+		buf.WriteString(c.Else.terminated())
+	}
+	buf.WriteString("fi")
+	return buf.String()
+}
+
+// String formats the command back into shell syntax
+func (c *WhileLoop) String() string {
+	keyword := "while "
+	if c.Until {
+		keyword = "until "
+	}
+	return keyword + c.Condition.terminated() + "do " + c.Body.terminated() + "done"
+}
+
+// String formats the command back into shell syntax
+func (c *ForLoop) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("for " + c.Name)
+	if c.Words != nil {
+		buf.WriteString(" in")
+		for _, word := range c.Words {
+			buf.WriteString(" " + formatWord(word))
+		}
+	}
+	buf.WriteString("; do " + c.Body.terminated() + "done")
+	return buf.String()
+}
+
+// String formats the command back into shell syntax
+func (c *CaseClause) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("case " + formatWord(c.Word) + " in ")
+	for _, item := range c.Items {
+		for i, pattern := range item.Patterns {
+			if i != 0 {
+				buf.WriteString(" | ")
+			}
+			buf.WriteString(formatWord(pattern))
+		}
+		buf.WriteString(") ")
+		if len(item.Body.Pipelines) > 0 {
+			buf.WriteString(item.Body.String() + " ")
+		}
+		buf.WriteString(";; ")
+	}
+	buf.WriteString("esac")
+	return buf.String()
+}
+
+// String formats the command back into shell syntax
+func (c *FunctionDef) String() string {
+	return c.Name + "() { " + c.Body.terminated() + "}"
+}
+
+// String formats the command back into shell syntax
+func (c *Subshell) String() string {
+	return "(" + c.Body.String() + ")"
+}
+
+// String formats the command back into shell syntax
+func (c *BraceGroup) String() string {
+	return "{ " + c.Body.terminated() + "}"
+}
+
+// String formats the command back into shell syntax
+func (c *ArithmeticCommand) String() string {
+	return "((" + c.Expression + "))"
+}
+
+// String formats the pipeline back into shell syntax
+func (p *Pipeline) String() string {
+	var buf bytes.Buffer
+	if p.Negated {
+		buf.WriteString("! ")
+	}
+	for i, c := range p.Commands {
+		if i != 0 {
+			buf.WriteString(" | ")
+		}
+		buf.WriteString(c.String())
+	}
+	return buf.String()
+}
+
+// String formats the list back into shell syntax
+func (l *List) String() string {
+	var buf bytes.Buffer
+	for i, p := range l.Pipelines {
+		buf.WriteString(p.String())
+		if op := l.Operators[i]; op != ";" || i != len(l.Pipelines)-1 {
+			if op != ";" {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(op)
+			if i != len(l.Pipelines)-1 {
+				buf.WriteByte(' ')
+			}
+		}
+	}
+	return buf.String()
+}
+
+// Formats the list with a separator following it, for a reserved word to
+// follow
+func (l *List) terminated() string {
+	if len(l.Operators) > 0 && l.Operators[len(l.Operators)-1] == "&" {
+		return l.String() + " "
+	}
+	return l.String() + "; "
+}
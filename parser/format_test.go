@@ -0,0 +1,68 @@
+package parser
+
+import "testing"
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"a", "b"}, "a b"},
+		{[]string{""}, "''"},
+		{[]string{"a b"}, "'a b'"},
+		{[]string{"it's"}, `it\'s`},
+		{[]string{"$HOME"}, `\$HOME`},
+		{[]string{"#x"}, `\#x`},
+		{[]string{"a#b"}, "a#b"},
+		{[]string{"~"}, `\~`},
+		{[]string{"a~"}, "a~"},
+		{[]string{"a\x01"}, `$'a\x01'`},
+		{[]string{"a\nb"}, `$'a\nb'`},
+		{[]string{"\xff"}, `$'\xff'`},
+		{[]string{"\u0085"}, `$'\u0085'`},
+		{[]string{"é"}, "é"},
+	}
+	for _, test := range tests {
+		if got := Format(test.args...); got != test.want {
+			t.Errorf("Format(%q) = %s, want %s", test.args, got, test.want)
+		}
+	}
+}
+
+func TestFormatParse(t *testing.T) {
+	args := []string{
+		"", "a", "a b", " ", "#", "#x", "# x", "a#b", "~", "~/x", "~user",
+		"it's", "'", `"`, "\\", "\\n", "$", "$HOME", "${x}", "$(ls)", "`ls`",
+		"*", "?", "[a]", "!x", "{a,b}", "a;b", "a|b", "a&b", "(x)", "<", ">",
+		"x=y", "a\tb", "a\nb", "\x01", "\x1b[0m", "\x7f", "\xff", "\xc3",
+		"é", "\u0085", "\u200b", "\U0001F600", "\\'\\",
+	}
+	for _, arg := range args {
+		formatted := Format(arg)
+		tokens, err := Parse(formatted)
+		if err != nil {
+			t.Errorf("Parse(Format(%q)) = Parse(%s) failed: %v", arg, formatted, err)
+			continue
+		}
+		if len(tokens) != 1 || tokens[0].Type != WordToken || tokens[0].Value != arg {
+			t.Errorf("Parse(Format(%q)) = Parse(%s) = %+v, want a single word", arg, formatted, tokens)
+		}
+	}
+}
+
+func TestListString(t *testing.T) {
+	tests := []string{
+		`echo $x "$y" 'a b' \$z`,
+		`a=$x b="c d" cmd "$(echo "a b")" $((1 + 2)) ""`,
+		`{ sleep 1; echo "$x"; } && echo ${x:-"a b"}`,
+		`echo a | tr a b >out.txt 2>&1`,
+	}
+	for _, test := range tests {
+		list, err := ParseList(test)
+		if err != nil {
+			t.Errorf("ParseList(%q) failed: %v", test, err)
+		} else if got := list.String(); got != test {
+			t.Errorf("ParseList(%q).String() = %q", test, got)
+		}
+	}
+}
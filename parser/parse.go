@@ -8,52 +8,293 @@ import (
 )
 
 var (
-	UnterminatedSingleQuoteError = errors.New("Unterminated single-quoted string")
-	UnterminatedDoubleQuoteError = errors.New("Unterminated double-quoted string")
-	UnterminatedEscapeError      = errors.New("Unterminated backslash-escape")
+	UnterminatedSingleQuoteError  = errors.New("Unterminated single-quoted string")
+	UnterminatedDoubleQuoteError  = errors.New("Unterminated double-quoted string")
+	UnterminatedEscapeError       = errors.New("Unterminated backslash-escape")
+	UnterminatedHereDocError      = errors.New("Unterminated here-document")
+	UnterminatedSubstitutionError = errors.New("Unterminated command substitution")
+	UnterminatedParameterError    = errors.New("Unterminated parameter expansion")
+	UnterminatedArithmeticError   = errors.New("Unterminated arithmetic expression")
 )
 
+// TokenType tells apart plain words from shell operators such as `|` or `>`
+type TokenType int
+
+const (
+	WordToken TokenType = iota
+	OperatorToken
+	ArithmeticToken // a `((...))` command, Value being its expression
+)
+
+// Token is a single word or operator read from the input
+type Token struct {
+	Type    TokenType
+	Value   string
+	Quoted  bool   // true for words containing quotes or backslash-escapes
+	HereDoc string // body of the here-document for `<<` and `<<-` operators
+	Word    Word   // parts of a word, telling apart quoting, command substitutions and arithmetic expansions
+}
+
 var (
 	splitChars        = " \n\t"
 	singleChar        = '\''
 	doubleChar        = '"'
 	escapeChar        = '\\'
 	doubleEscapeChars = "$`\"\n\\"
+	commentChar       = '#'
+	metaChars         = "|&<>;()"
 )
 
-// Split splits a string according to /bin/sh's word-splitting rules. It
-// supports backslash-escapes, single-quotes, and double-quotes. Notably it does
-// not support the $'' style of quoting. It also doesn't attempt to perform any
-// other sort of expansion, including brace expansion, shell expansion, or
-// pathname expansion.
+// operators lists every operator, longest first so that the first match wins
+var operators = []string{
+	"&>>", "<<<", "<<-",
+	"&&", "||", ">>", ">&", "&>", "<<", ";;",
+	">", "<", "|", "&", ";", "(", ")",
+}
+
+// Parse splits a string according to /bin/sh's word-splitting rules. It
+// supports backslash-escapes, single-quotes, and double-quotes, as well as
+// `$'...'` strings, whose C-style backslash-escapes are decoded, and `$"..."`
+// strings, read as double-quoted ones. It also doesn't attempt to perform any
+// sort of expansion, including brace expansion, shell expansion, or pathname
+// expansion, but keeps track of how each part of a word was quoted, and of
+// `$(...)` and backtick command substitutions and `$((...))` arithmetic
+// expansions, in the word tokens' Word.
+//
+// A `((...))` arithmetic command is returned as a single ArithmeticToken
+// holding its expression.
+//
+// Unquoted operators (`|`, `&&`, `||`, `;`, `;;`, `&`, `(`, `)`, `<`, `>`,
+// `>>`, `>&`, `&>`, `&>>`, `<<`, `<<-` and `<<<`) are returned as separate
+// OperatorTokens even when not surrounded by spaces, and so are newlines. A redirection operator directly
+// preceded by a file descriptor number, as in `2>`, is returned as a single
+// token including that number. Unquoted words starting with `#` start a
+// comment running until the end of the line.
 //
-// If the given input has an unterminated quoted string or ends in a
+// The lines following a line containing `<<` or `<<-` operators are read as
+// the bodies of these here-documents, up to their delimiter line, and stored
+// in the operator token.
+//
+// If the given input has an unterminated quoted string, command substitution,
+// parameter expansion, arithmetic command or here-document, or ends in a
 // backslash-escape, one of UnterminatedSingleQuoteError,
-// UnterminatedDoubleQuoteError, or UnterminatedEscapeError is returned.
-func Parse(input string) (words []string, err error) {
+// UnterminatedDoubleQuoteError, UnterminatedSubstitutionError,
+// UnterminatedParameterError, UnterminatedArithmeticError,
+// UnterminatedHereDocError, or UnterminatedEscapeError is returned.
+// IsIncomplete tells these errors apart from others.
+func Parse(input string) (tokens []Token, err error) {
 	var buf bytes.Buffer
-	words = make([]string, 0)
+	tokens = make([]Token, 0)
+	hereDocs := make([]int, 0) // indexes of here-document operators awaiting a body
 
 	for len(input) > 0 {
-		// skip any splitChars at the start
 		c, l := utf8.DecodeRuneInString(input)
+
+		// newlines separate commands, and start pending here-documents
+		if c == '\n' {
+			tokens = append(tokens, Token{Type: OperatorToken, Value: "\n"})
+			input = input[l:]
+			for _, i := range hereDocs {
+				if i+1 >= len(tokens) || tokens[i+1].Type != WordToken {
+					continue // missing delimiter, reported when parsing commands
+				}
+				stripTabs := strings.HasSuffix(tokens[i].Value, "<<-")
+				tokens[i].HereDoc, input, err = readHereDoc(input, tokens[i+1].Value, stripTabs)
+				if err != nil {
+					return
+				}
+			}
+			hereDocs = hereDocs[:0]
+			continue
+		}
+
+		// skip any splitChars at the start
 		if strings.ContainsRune(splitChars, c) {
 			input = input[l:]
 			continue
 		}
 
-		var word string
-		word, input, err = splitWord(input, &buf)
+		// skip comments up to the end of the line
+		if c == commentChar {
+			if i := strings.IndexRune(input, '\n'); i != -1 {
+				input = input[i:]
+			} else {
+				input = ""
+			}
+			continue
+		}
+
+		if strings.HasPrefix(input, "((") {
+			var end int
+			var ok bool
+			if end, ok, err = arithmeticEnd(input[2:]); err != nil {
+				return
+			}
+			if ok {
+				tokens = append(tokens, Token{Type: ArithmeticToken, Value: input[2 : 2+end-2]})
+				input = input[2+end:]
+				continue
+			}
+		}
+
+		if op := matchOperator(input); op != "" {
+			if kind := strings.TrimLeft(op, "0123456789"); kind == "<<" || kind == "<<-" {
+				hereDocs = append(hereDocs, len(tokens))
+			}
+			tokens = append(tokens, Token{Type: OperatorToken, Value: op})
+			input = input[len(op):]
+			continue
+		}
+
+		var token Token
+		token, input, err = splitWord(input, &buf)
 		if err != nil {
 			return
 		}
-		words = append(words, word)
+		tokens = append(tokens, token)
+	}
+	if len(hereDocs) > 0 {
+		err = UnterminatedHereDocError
 	}
 	return
 }
 
-func splitWord(input string, buf *bytes.Buffer) (word string, remainder string, err error) {
+// IsIncomplete returns true if err was caused by input ending too early, in
+// which case reading more lines might complete it
+func IsIncomplete(err error) bool {
+	switch err {
+	case UnterminatedSingleQuoteError, UnterminatedDoubleQuoteError,
+		UnterminatedEscapeError, UnterminatedHereDocError, UnterminatedSubstitutionError,
+		UnterminatedParameterError, UnterminatedArithmeticError,
+		UnterminatedPipelineError, UnterminatedListError, UnterminatedCompoundError:
+		return true
+	}
+	return false
+}
+
+// readHereDoc reads lines from input up to the delimiter line, optionally
+// stripping leading tabs
+func readHereDoc(input, delimiter string, stripTabs bool) (body string, remainder string, err error) {
+	var buf bytes.Buffer
+	for len(input) > 0 {
+		line := input
+		if i := strings.IndexRune(input, '\n'); i != -1 {
+			line, input = input[:i], input[i+1:]
+		} else {
+			input = ""
+		}
+		if stripTabs {
+			line = strings.TrimLeft(line, "\t")
+		}
+		if line == delimiter {
+			return buf.String(), input, nil
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return "", "", UnterminatedHereDocError
+}
+
+// matchOperator returns the operator input starts with, if any, including
+// the file descriptor number prefixing a redirection
+func matchOperator(input string) string {
+	digits := 0
+	for digits < len(input) && input[digits] >= '0' && input[digits] <= '9' {
+		digits++
+	}
+	for _, op := range operators {
+		if !strings.HasPrefix(input[digits:], op) {
+			continue
+		}
+		if digits > 0 && (op[0] == '&' || !strings.ContainsAny(op, "<>")) {
+			return "" // only redirections take a file descriptor
+		}
+		return input[:digits+len(op)]
+	}
+	return ""
+}
+
+// Characters that, right before a parenthesis, start an extended pattern
+const extglobChars = "?*+@!"
+
+// extglobEnd returns the length of the rest of an extended pattern, input
+// starting right after its opening parenthesis, including the closing one,
+// or -1 if it isn't closed on the same line
+func extglobEnd(input string) int {
+	depth := 1
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		case '\n':
+			return -1
+		}
+	}
+	return -1
+}
+
+// isWordEnd returns true if the unquoted input starts with something that
+// terminates the current word
+func isWordEnd(input string) bool {
+	c, _ := utf8.DecodeRuneInString(input)
+	return strings.ContainsRune(splitChars, c) || strings.ContainsRune(metaChars, c)
+}
+
+// splitWord reads the word input starts with into a word token, split in parts
+// according to their quoting
+func splitWord(input string, buf *bytes.Buffer) (token Token, remainder string, err error) {
 	buf.Reset()
+	token.Type = WordToken
+	literal := 0 // start of the text not yet added to the word's parts
+
+	// adds the text read since the last part as a new part, quoted parts
+	// being kept even when empty as `''` still makes a word
+	addPart := func(quoting Quoting) {
+		if buf.Len() > literal || quoting != Unquoted {
+			token.Word = append(token.Word, WordPart{Value: buf.String()[literal:], Quoting: quoting})
+			literal = buf.Len()
+		}
+	}
+	// adds the command substitution, arithmetic expansion or parameter
+	// expansion input starts with to the word, if any. Parameter expansions
+	// are kept in the text, but read whole as they can contain spaces, as in
+	// `${NAME:-a b}`.
+	substitute := func(quoting Quoting) bool {
+		if strings.HasPrefix(input, "${") {
+			var end int
+			if end, err = ParameterEnd(input[2:]); err != nil {
+				return false
+			}
+			buf.WriteString(input[:2+end])
+			input = input[2+end:]
+			return true
+		}
+		var command string
+		var ok, arithmetic bool
+		command, remainder, arithmetic, err = readArithmetic(input)
+		ok = arithmetic
+		if !ok && err == nil {
+			command, remainder, ok, err = readSubstitution(input)
+		}
+		if !ok || err != nil {
+			return ok
+		}
+		if buf.Len() > literal {
+			addPart(quoting)
+		}
+		token.Word = append(token.Word, WordPart{Value: command, Substitution: !arithmetic, Arithmetic: arithmetic, Quoting: quoting})
+		buf.WriteString(input[:len(input)-len(remainder)])
+		literal = buf.Len()
+		input = remainder
+		return true
+	}
 
 raw:
 	{
@@ -63,19 +304,54 @@ raw:
 			cur = cur[l:]
 			if c == singleChar {
 				buf.WriteString(input[0 : len(input)-len(cur)-l])
+				addPart(Unquoted)
 				input = cur
+				token.Quoted = true
 				goto single
 			} else if c == doubleChar {
 				buf.WriteString(input[0 : len(input)-len(cur)-l])
+				addPart(Unquoted)
 				input = cur
+				token.Quoted = true
 				goto double
 			} else if c == escapeChar {
 				buf.WriteString(input[0 : len(input)-len(cur)-l])
+				addPart(Unquoted)
 				input = cur
+				token.Quoted = true
 				goto escape
-			} else if strings.ContainsRune(splitChars, c) {
+			} else if c == '$' && strings.HasPrefix(cur, "'") {
+				buf.WriteString(input[0 : len(input)-len(cur)-l])
+				addPart(Unquoted)
+				input = cur[1:]
+				token.Quoted = true
+				goto ansi
+			} else if c == '$' && strings.HasPrefix(cur, "\"") {
+				// `$"..."` strings are double-quoted ones, without translations
+				buf.WriteString(input[0 : len(input)-len(cur)-l])
+				addPart(Unquoted)
+				input = cur[1:]
+				token.Quoted = true
+				goto double
+			} else if c == '$' || c == '`' {
 				buf.WriteString(input[0 : len(input)-len(cur)-l])
-				return buf.String(), cur, nil
+				input = input[len(input)-len(cur)-l:]
+				if substitute(Unquoted) {
+					goto raw
+				} else if err != nil {
+					return Token{}, "", err
+				}
+				buf.WriteRune(c)
+				input = cur
+			} else if i := len(input) - len(cur) - l; c == '(' && i > 0 && strings.IndexByte(extglobChars, input[i-1]) != -1 && extglobEnd(cur) != -1 {
+				// the parentheses of extended patterns like `!(*.o)` and
+				// `+(a|b)` are part of the word
+				cur = cur[extglobEnd(cur):]
+			} else if isWordEnd(input[len(input)-len(cur)-l:]) {
+				end := len(input) - len(cur) - l
+				buf.WriteString(input[0:end])
+				input = input[end:]
+				goto done
 			}
 		}
 		if len(input) > 0 {
@@ -88,13 +364,14 @@ raw:
 escape:
 	{
 		if len(input) == 0 {
-			return "", "", UnterminatedEscapeError
+			return Token{}, "", UnterminatedEscapeError
 		}
 		c, l := utf8.DecodeRuneInString(input)
 		if c == '\n' {
 			// a backslash-escaped newline is elided from the output entirely
 		} else {
 			buf.WriteString(input[:l])
+			addPart(SingleQuoted)
 		}
 		input = input[l:]
 	}
@@ -104,13 +381,26 @@ single:
 	{
 		i := strings.IndexRune(input, singleChar)
 		if i == -1 {
-			return "", "", UnterminatedSingleQuoteError
+			return Token{}, "", UnterminatedSingleQuoteError
 		}
 		buf.WriteString(input[0:i])
+		addPart(SingleQuoted)
 		input = input[i+1:]
 		goto raw
 	}
 
+ansi:
+	{
+		end := ansiQuotedEnd(input)
+		if end == -1 {
+			return Token{}, "", UnterminatedSingleQuoteError
+		}
+		buf.WriteString(unescapeANSI(input[:end-1]))
+		addPart(SingleQuoted)
+		input = input[end:]
+		goto raw
+	}
+
 double:
 	{
 		cur := input
@@ -119,6 +409,7 @@ double:
 			cur = cur[l:]
 			if c == doubleChar {
 				buf.WriteString(input[0 : len(input)-len(cur)-l])
+				addPart(DoubleQuoted)
 				input = cur
 				goto raw
 			} else if c == escapeChar {
@@ -130,15 +421,33 @@ double:
 					if c2 == '\n' {
 						// newline is special, skip the backslash entirely
 					} else {
+						// the escaped character is taken literally, `\$`
+						// isn't the start of a variable
+						if buf.Len() > literal {
+							addPart(DoubleQuoted)
+						}
 						buf.WriteRune(c2)
+						addPart(SingleQuoted)
 					}
 					input = cur
 				}
+			} else if c == '$' || c == '`' {
+				buf.WriteString(input[0 : len(input)-len(cur)-l])
+				input = input[len(input)-len(cur)-l:]
+				if substitute(DoubleQuoted) {
+					goto double
+				} else if err != nil {
+					return Token{}, "", err
+				}
+				buf.WriteRune(c)
+				input = cur
 			}
 		}
-		return "", "", UnterminatedDoubleQuoteError
+		return Token{}, "", UnterminatedDoubleQuoteError
 	}
 
 done:
-	return buf.String(), input, nil
+	addPart(Unquoted)
+	token.Value = buf.String()
+	return token, input, nil
 }
@@ -0,0 +1,449 @@
+package parser
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// Quoting tells how a part of a word was quoted, which decides how it gets
+// expanded
+type Quoting int
+
+const (
+	Unquoted     Quoting = iota
+	SingleQuoted         // also used for backslash-escaped characters, taken literally
+	DoubleQuoted
+)
+
+// WordPart is a piece of a word, either text, the command of a `$(...)` or
+// backtick substitution or the expression of a `$((...))` arithmetic
+// expansion, along with its quoting
+type WordPart struct {
+	Value        string
+	Substitution bool // true for command substitutions, Value being the command
+	Arithmetic   bool // true for arithmetic expansions, Value being the expression
+	Quoting      Quoting
+}
+
+// Word is a word split in the parts that get expanded differently
+type Word []WordPart
+
+// String returns the word's text, without its quotes, with substitutions in
+// their `$(...)` form
+func (w Word) String() string {
+	var buf bytes.Buffer
+	for _, part := range w {
+		if part.Arithmetic {
+			buf.WriteString("$((" + part.Value + "))")
+		} else if part.Substitution {
+			buf.WriteString("$(" + part.Value + ")")
+		} else {
+			buf.WriteString(part.Value)
+		}
+	}
+	return buf.String()
+}
+
+// LiteralWord returns a word made of the given text only, taken literally
+func LiteralWord(text string) Word {
+	return Word{{Value: text, Quoting: SingleQuoted}}
+}
+
+// ParseHereDoc splits the body of a here-document into literal text, command
+// substitutions and arithmetic expansions, like in a double-quoted string. Backslashes only
+// escape `$`, "`" and `\`.
+func ParseHereDoc(body string) (Word, error) {
+	var buf bytes.Buffer
+	word := Word{}
+	for len(body) > 0 {
+		if body[0] == '\\' && len(body) > 1 && strings.IndexByte("$`\\", body[1]) != -1 {
+			if buf.Len() > 0 {
+				word = append(word, WordPart{Value: buf.String(), Quoting: DoubleQuoted})
+				buf.Reset()
+			}
+			word = append(word, WordPart{Value: body[1:2], Quoting: SingleQuoted})
+			body = body[2:]
+			continue
+		}
+		if strings.HasPrefix(body, "${") {
+			end, err := ParameterEnd(body[2:])
+			if err != nil {
+				return nil, err
+			}
+			buf.WriteString(body[:2+end])
+			body = body[2+end:]
+			continue
+		}
+		command, remainder, arithmetic, err := readArithmetic(body)
+		ok := arithmetic
+		if !ok && err == nil {
+			command, remainder, ok, err = readSubstitution(body)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			buf.WriteByte(body[0])
+			body = body[1:]
+			continue
+		}
+		if buf.Len() > 0 {
+			word = append(word, WordPart{Value: buf.String(), Quoting: DoubleQuoted})
+			buf.Reset()
+		}
+		word = append(word, WordPart{Value: command, Substitution: !arithmetic, Arithmetic: arithmetic, Quoting: DoubleQuoted})
+		body = remainder
+	}
+	if buf.Len() > 0 || len(word) == 0 {
+		word = append(word, WordPart{Value: buf.String(), Quoting: DoubleQuoted})
+	}
+	return word, nil
+}
+
+// ParseWord splits text into the parts of a single word, even if it contains
+// whitespace or operators, as found in `${NAME:-word}`
+func ParseWord(text string) (Word, error) {
+	var buf bytes.Buffer
+	word := Word{}
+	for len(text) > 0 {
+		if isWordEnd(text) {
+			_, l := utf8.DecodeRuneInString(text)
+			word = append(word, WordPart{Value: text[:l]})
+			text = text[l:]
+			continue
+		}
+		token, remainder, err := splitWord(text, &buf)
+		if err != nil {
+			return nil, err
+		}
+		word = append(word, token.Word...)
+		text = remainder
+	}
+	return word, nil
+}
+
+// ParameterEnd returns the length of a `${...}` parameter expansion, input
+// starting right after `${`, including the closing brace. Quotes, command
+// substitutions and nested parameter expansions are skipped over.
+func ParameterEnd(input string) (int, error) {
+	depth := 1
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+		case '\'':
+			end := strings.IndexByte(input[i+1:], '\'')
+			if end == -1 {
+				return 0, UnterminatedParameterError
+			}
+			i += end + 1
+		case '"':
+			end, err := doubleQuotedEnd(input[i+1:])
+			if err != nil {
+				return 0, err
+			}
+			i += end
+		case '`':
+			end, err := backtickEnd(input[i+1:])
+			if err != nil {
+				return 0, err
+			}
+			i += end
+		case '$':
+			if strings.HasPrefix(input[i:], "$(") {
+				end, err := substitutionEnd(input[i+2:])
+				if err != nil {
+					return 0, err
+				}
+				i += end + 1
+			} else if strings.HasPrefix(input[i:], "$'") {
+				end := ansiQuotedEnd(input[i+2:])
+				if end == -1 {
+					return 0, UnterminatedParameterError
+				}
+				i += end + 1
+			} else if strings.HasPrefix(input[i:], "${") {
+				depth++
+				i++
+			}
+		case '}':
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		}
+	}
+	return 0, UnterminatedParameterError
+}
+
+// readSubstitution reads the `$(...)` or backtick command substitution input
+// starts with, if any, returning its command and the input following it
+func readSubstitution(input string) (command string, remainder string, ok bool, err error) {
+	if strings.HasPrefix(input, "$(") {
+		end, err := substitutionEnd(input[2:])
+		if err != nil {
+			return "", "", false, err
+		}
+		return input[2 : 2+end-1], input[2+end:], true, nil
+	}
+	if strings.HasPrefix(input, "`") {
+		end, err := backtickEnd(input[1:])
+		if err != nil {
+			return "", "", false, err
+		}
+		return unescapeBackticks(input[1 : 1+end-1]), input[1+end:], true, nil
+	}
+	return "", "", false, nil
+}
+
+// readArithmetic reads the `$((...))` arithmetic expansion input starts with,
+// if any, returning its expression and the input following it
+func readArithmetic(input string) (expr string, remainder string, ok bool, err error) {
+	if !strings.HasPrefix(input, "$((") {
+		return "", "", false, nil
+	}
+	end, ok, err := arithmeticEnd(input[3:])
+	if err != nil {
+		return "", "", false, err
+	}
+	if !ok {
+		// `$((a) (b))` is a command substitution, let it be read as such
+		return "", "", false, nil
+	}
+	return input[3 : 3+end-2], input[3+end:], true, nil
+}
+
+// arithmeticEnd returns the length of an arithmetic expression, input
+// starting right after `((` or `$((`, including the closing `))`. It returns
+// false when the parentheses close in a way that doesn't end the expression,
+// as in `((a) (b))`.
+func arithmeticEnd(input string) (int, bool, error) {
+	depth := 0
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			} else if i+1 < len(input) && input[i+1] == ')' {
+				return i + 2, true, nil
+			} else {
+				return 0, false, nil
+			}
+		}
+	}
+	return 0, false, UnterminatedArithmeticError
+}
+
+// substitutionEnd returns the length of a `$(...)` substitution's command,
+// input starting right after `$(`, including the closing parenthesis. Quotes
+// and nested substitutions are skipped over.
+func substitutionEnd(input string) (int, error) {
+	depth := 1
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+		case '\'':
+			end := strings.IndexByte(input[i+1:], '\'')
+			if end == -1 {
+				return 0, UnterminatedSubstitutionError
+			}
+			i += end + 1
+		case '$':
+			if strings.HasPrefix(input[i:], "$'") {
+				end := ansiQuotedEnd(input[i+2:])
+				if end == -1 {
+					return 0, UnterminatedSubstitutionError
+				}
+				i += end + 1
+			}
+		case '"':
+			end, err := doubleQuotedEnd(input[i+1:])
+			if err != nil {
+				return 0, err
+			}
+			i += end
+		case '`':
+			end, err := backtickEnd(input[i+1:])
+			if err != nil {
+				return 0, err
+			}
+			i += end
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		}
+	}
+	return 0, UnterminatedSubstitutionError
+}
+
+// ansiQuotedEnd returns the length of a `$'...'` string, input starting
+// right after the opening quote, including the closing one, -1 if it isn't
+// closed. Quotes can be escaped within it.
+func ansiQuotedEnd(input string) int {
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+		case '\'':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Escapes of `$'...'` strings standing for a single character
+var ansiEscapes = map[byte]string{
+	'a': "\a", 'b': "\b", 'e': "\x1b", 'E': "\x1b", 'f': "\f", 'n': "\n",
+	'r': "\r", 't': "\t", 'v': "\v", '\\': "\\", '\'': "'", '"': "\"", '?': "?",
+}
+
+// unescapeANSI decodes the backslash-escapes of the body of a `$'...'`
+// string: the C escapes like `\n` and `\t`, `\e` for escape, `\nnn` in octal,
+// `\xHH` in hexadecimal, `\uHHHH` and `\UHHHHHHHH` for unicode characters and
+// `\cX` for control characters. A NUL character ends the string.
+func unescapeANSI(body string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(body); i++ {
+		if body[i] != '\\' || i+1 == len(body) {
+			buf.WriteByte(body[i])
+			continue
+		}
+		i++
+		c := body[i]
+		if escape, ok := ansiEscapes[c]; ok {
+			buf.WriteString(escape)
+			continue
+		}
+
+		var value rune
+		n := 0
+		switch {
+		case c >= '0' && c <= '7':
+			value, n = readDigits(body[i:], 8, 3)
+			i += n - 1
+			buf.WriteByte(byte(value))
+		case c == 'x':
+			value, n = readDigits(body[i+1:], 16, 2)
+			i += n
+			if n == 0 {
+				buf.WriteString("\\x")
+			} else {
+				buf.WriteByte(byte(value))
+			}
+		case c == 'u' || c == 'U':
+			size := 4
+			if c == 'U' {
+				size = 8
+			}
+			value, n = readDigits(body[i+1:], 16, size)
+			i += n
+			if n == 0 {
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			} else {
+				buf.WriteRune(value)
+			}
+		case c == 'c' && i+1 < len(body):
+			i++
+			if body[i] == '?' {
+				buf.WriteByte(0x7f)
+			} else {
+				buf.WriteByte(body[i] & 0x1f)
+			}
+		default:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		}
+	}
+
+	decoded := buf.String()
+	if i := strings.IndexByte(decoded, 0); i != -1 {
+		decoded = decoded[:i]
+	}
+	return decoded
+}
+
+// Reads up to max digits in the given base from the start of text, returning
+// their value and how many there were
+func readDigits(text string, base, max int) (rune, int) {
+	var value rune
+	n := 0
+	for n < max && n < len(text) {
+		c, digit := text[n], base
+		if c >= '0' && c <= '9' {
+			digit = int(c - '0')
+		} else if c >= 'a' && c <= 'f' {
+			digit = int(c-'a') + 10
+		} else if c >= 'A' && c <= 'F' {
+			digit = int(c-'A') + 10
+		}
+		if digit >= base {
+			break
+		}
+		value = value*rune(base) + rune(digit)
+		n++
+	}
+	return value, n
+}
+
+// doubleQuotedEnd returns the length of a double-quoted string, input
+// starting right after the opening quote, including the closing one
+func doubleQuotedEnd(input string) (int, error) {
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		case '`':
+			end, err := backtickEnd(input[i+1:])
+			if err != nil {
+				return 0, err
+			}
+			i += end
+		case '$':
+			if strings.HasPrefix(input[i:], "$(") {
+				end, err := substitutionEnd(input[i+2:])
+				if err != nil {
+					return 0, err
+				}
+				i += end + 1
+			}
+		}
+	}
+	return 0, UnterminatedSubstitutionError
+}
+
+// backtickEnd returns the length of a backtick substitution's command, input
+// starting right after the opening backtick, including the closing one
+func backtickEnd(input string) (int, error) {
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+		case '`':
+			return i + 1, nil
+		}
+	}
+	return 0, UnterminatedSubstitutionError
+}
+
+// Within backticks, backslashes only escape `$`, "`" and `\`
+func unescapeBackticks(command string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(command); i++ {
+		if command[i] == '\\' && i+1 < len(command) && strings.IndexByte("$`\\", command[i+1]) != -1 {
+			i++
+		}
+		buf.WriteByte(command[i])
+	}
+	return buf.String()
+}
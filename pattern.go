@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+)
+
+// Characters with a special meaning in patterns, the parentheses and bar
+// being part of extended patterns
+const globChars = "*?[\\()|"
+
+// Escapes the characters of text that have a special meaning in patterns, for
+// it to be matched literally
+func escapeGlob(text string) string {
+	var buf bytes.Buffer
+	for _, c := range text {
+		if strings.ContainsRune(globChars, c) {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+// matchOptions change how patterns match, following the shell's options
+type matchOptions struct {
+	foldCase bool // letters match regardless of their case
+	extended bool // `?(...)`, `*(...)`, `+(...)`, `@(...)` and `!(...)` groups are recognized
+}
+
+// Returns how patterns match with the shell's current options
+func (s *State) matchOptions() matchOptions {
+	return matchOptions{extended: s.ShellOptions["extglob"]}
+}
+
+// matchPattern reports whether the whole of text matches the shell pattern.
+// `*` matches any string and `?` any character, slashes included, `[...]`
+// matches one of a set of characters and `\` escapes the next character.
+// Extended groups match their patterns, separated by `|`: `@(...)` once,
+// `?(...)` at most once, `*(...)` any number of times, `+(...)` at least once
+// and `!(...)` matches anything they don't.
+func matchPattern(pattern, text string, options matchOptions) bool {
+	p, t := []rune(pattern), []rune(text)
+	if options.extended && hasExtendedGroup(p) {
+		return options.matchExtended(p, t)
+	}
+
+	px, tx := 0, 0
+	starPx, starTx := 0, 0 // where to resume from after the last `*`, if any
+	for px < len(p) || tx < len(t) {
+		if px < len(p) {
+			switch p[px] {
+			case '*':
+				starPx, starTx = px, tx+1
+				px++
+				continue
+			case '?':
+				if tx < len(t) {
+					px++
+					tx++
+					continue
+				}
+			case '[':
+				if tx < len(t) {
+					matched, end := options.matchBracket(p, px, t[tx])
+					if end == -1 && t[tx] == '[' {
+						// unterminated brackets are taken literally
+						px++
+						tx++
+						continue
+					} else if matched {
+						px = end
+						tx++
+						continue
+					}
+				}
+			case '\\':
+				c := '\\'
+				if px+1 < len(p) {
+					c = p[px+1]
+				}
+				if tx < len(t) && options.equal(t[tx], c) {
+					px += 2
+					tx++
+					continue
+				}
+			default:
+				if tx < len(t) && options.equal(t[tx], p[px]) {
+					px++
+					tx++
+					continue
+				}
+			}
+		}
+		// let the last `*` match one more character and try again
+		if starTx > 0 && starTx <= len(t) {
+			px, tx = starPx, starTx
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// Matches text against a pattern containing extended groups, trying every
+// way of splitting text between the parts of the pattern
+func (o matchOptions) matchExtended(p, t []rune) bool {
+	if len(p) == 0 {
+		return len(t) == 0
+	}
+
+	if end := extendedGroupEnd(p, 0); end != -1 {
+		alternatives := splitAlternatives(p[2 : end-1])
+		rest := p[end:]
+		matchesAny := func(text []rune) bool {
+			for _, alternative := range alternatives {
+				if o.matchExtended(alternative, text) {
+					return true
+				}
+			}
+			return false
+		}
+
+		switch p[0] {
+		case '!':
+			for k := 0; k <= len(t); k++ {
+				if !matchesAny(t[:k]) && o.matchExtended(rest, t[k:]) {
+					return true
+				}
+			}
+		case '?', '@':
+			if p[0] == '?' && o.matchExtended(rest, t) {
+				return true
+			}
+			for k := 0; k <= len(t); k++ {
+				if matchesAny(t[:k]) && o.matchExtended(rest, t[k:]) {
+					return true
+				}
+			}
+		case '*', '+':
+			if o.matchExtended(rest, t) && (p[0] == '*' || matchesAny(nil)) {
+				return true
+			}
+			// after one match of the group, any number of others can follow
+			repeated := append([]rune{'*'}, p[1:]...)
+			for k := 1; k <= len(t); k++ {
+				if matchesAny(t[:k]) && o.matchExtended(repeated, t[k:]) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	switch p[0] {
+	case '*':
+		for k := 0; k <= len(t); k++ {
+			if o.matchExtended(p[1:], t[k:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return len(t) > 0 && o.matchExtended(p[1:], t[1:])
+	case '[':
+		if len(t) == 0 {
+			return false
+		}
+		if matched, end := o.matchBracket(p, 0, t[0]); end != -1 {
+			return matched && o.matchExtended(p[end:], t[1:])
+		}
+		// unterminated brackets are taken literally
+		return t[0] == '[' && o.matchExtended(p[1:], t[1:])
+	case '\\':
+		c, n := '\\', 1
+		if len(p) > 1 {
+			c, n = p[1], 2
+		}
+		return len(t) > 0 && o.equal(t[0], c) && o.matchExtended(p[n:], t[1:])
+	}
+	return len(t) > 0 && o.equal(t[0], p[0]) && o.matchExtended(p[1:], t[1:])
+}
+
+// Returns true if the pattern has an unescaped extended group
+func hasExtendedGroup(p []rune) bool {
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' {
+			i++
+		} else if extendedGroupEnd(p, i) != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the index following the extended group starting at p[start], like
+// `+(a|b)`, -1 if there is none
+func extendedGroupEnd(p []rune, start int) int {
+	if start+1 >= len(p) || !strings.ContainsRune("?*+@!", p[start]) || p[start+1] != '(' {
+		return -1
+	}
+	depth := 0
+	for i := start + 1; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// Splits the inside of an extended group on the bars that aren't part of a
+// nested group
+func splitAlternatives(p []rune) [][]rune {
+	alternatives := [][]rune{}
+	depth, start := 0, 0
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '|':
+			if depth == 0 {
+				alternatives = append(alternatives, p[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(alternatives, p[start:])
+}
+
+// Compares a character of text with one of a pattern
+func (o matchOptions) equal(c, p rune) bool {
+	return c == p || (o.foldCase && unicode.ToLower(c) == unicode.ToLower(p))
+}
+
+// matchBracket matches c against the `[...]` expression starting at p[start],
+// returning whether it matched and the index following the expression, -1 if
+// it isn't terminated
+func (o matchOptions) matchBracket(p []rune, start int, c rune) (bool, int) {
+	if o.foldCase {
+		lower, end := matchBracket(p, start, unicode.ToLower(c))
+		upper, _ := matchBracket(p, start, unicode.ToUpper(c))
+		if start+1 < len(p) && (p[start+1] == '!' || p[start+1] == '^') {
+			return lower && upper, end
+		}
+		return lower || upper, end
+	}
+	return matchBracket(p, start, c)
+}
+
+func matchBracket(p []rune, start int, c rune) (bool, int) {
+	i := start + 1
+	negate := false
+	if i < len(p) && (p[i] == '!' || p[i] == '^') {
+		negate = true
+		i++
+	}
+
+	matched := false
+	for first := true; i < len(p); first = false {
+		if p[i] == ']' && !first {
+			return matched != negate, i + 1
+		}
+		if p[i] == '[' && i+1 < len(p) && p[i+1] == ':' {
+			end := i + 2
+			for end+1 < len(p) && !(p[end] == ':' && p[end+1] == ']') {
+				end++
+			}
+			if end+1 < len(p) {
+				matched = matched || matchClass(string(p[i+2:end]), c)
+				i = end + 2
+				continue
+			}
+		}
+
+		lo := p[i]
+		if lo == '\\' && i+1 < len(p) {
+			i++
+			lo = p[i]
+		}
+		i++
+		hi := lo
+		if i+1 < len(p) && p[i] == '-' && p[i+1] != ']' {
+			i++
+			if p[i] == '\\' && i+1 < len(p) {
+				i++
+			}
+			hi = p[i]
+			i++
+		}
+		matched = matched || (lo <= c && c <= hi)
+	}
+	return false, -1
+}
+
+// Matches c against a character class like the `alpha` of `[[:alpha:]]`
+func matchClass(class string, c rune) bool {
+	switch class {
+	case "alnum":
+		return unicode.IsLetter(c) || unicode.IsDigit(c)
+	case "alpha":
+		return unicode.IsLetter(c)
+	case "blank":
+		return c == ' ' || c == '\t'
+	case "cntrl":
+		return unicode.IsControl(c)
+	case "digit":
+		return c >= '0' && c <= '9'
+	case "graph":
+		return unicode.IsGraphic(c) && !unicode.IsSpace(c)
+	case "lower":
+		return unicode.IsLower(c)
+	case "print":
+		return unicode.IsPrint(c)
+	case "punct":
+		return unicode.IsPunct(c) || unicode.IsSymbol(c)
+	case "space":
+		return unicode.IsSpace(c)
+	case "upper":
+		return unicode.IsUpper(c)
+	case "xdigit":
+		return strings.ContainsRune("0123456789abcdefABCDEF", c)
+	}
+	return false
+}
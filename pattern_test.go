@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	plain := matchOptions{}
+	foldCase := matchOptions{foldCase: true}
+	extended := matchOptions{extended: true}
+	tests := []struct {
+		pattern string
+		text    string
+		options matchOptions
+		want    bool
+	}{
+		{"", "", plain, true},
+		{"", "a", plain, false},
+		{"abc", "abc", plain, true},
+		{"abc", "abd", plain, false},
+		{"*", "", plain, true},
+		{"*", "a/b", plain, true},
+		{"a*c", "abbbc", plain, true},
+		{"a*c", "abbbd", plain, false},
+		{"*.go", "main.go", plain, true},
+		{"*a*b", "xaxxab", plain, true},
+		{"?", "é", plain, true},
+		{"??", "a", plain, false},
+		{"[abc]", "b", plain, true},
+		{"[abc]", "d", plain, false},
+		{"[a-c]x", "bx", plain, true},
+		{"[!a]x", "bx", plain, true},
+		{"[!a]x", "ax", plain, false},
+		{"[^a]", "a", plain, false},
+		{"[]]", "]", plain, true},
+		{"[a-]", "-", plain, true},
+		{"[[:digit:]]*", "1a", plain, true},
+		{"[[:alpha:]]", "1", plain, false},
+		{"[abc", "a", plain, false},
+		{"[abc", "[abc", plain, true},
+		{`\*`, "*", plain, true},
+		{`\*`, "a", plain, false},
+		{`a\?`, "ab", plain, false},
+		{"A*", "abc", plain, false},
+		{"A*", "abc", foldCase, true},
+		{"[A-C]", "b", foldCase, true},
+		{"[!a]", "A", foldCase, false},
+		{"[!a]", "b", foldCase, true},
+		{"+(ab)", "abab", plain, false},
+		{"+(ab)", "+(ab)", plain, true},
+		{"+(ab)", "abab", extended, true},
+		{"+(ab)", "", extended, false},
+		{"*(ab)", "", extended, true},
+		{"*(ab)x", "ababx", extended, true},
+		{"?(a)b", "b", extended, true},
+		{"?(a)b", "aab", extended, false},
+		{"@(a|b)c", "bc", extended, true},
+		{"@(a|b)c", "abc", extended, false},
+		{"!(foo)", "bar", extended, true},
+		{"!(foo)", "foo", extended, false},
+		{"!(*.go)", "main.go", extended, false},
+		{"*.@(c|h)", "x.h", extended, true},
+		{"@(a|*(b))c", "bbbc", extended, true},
+	}
+	for _, test := range tests {
+		if got := matchPattern(test.pattern, test.text, test.options); got != test.want {
+			t.Errorf("matchPattern(%q, %q, %+v) = %v, want %v", test.pattern, test.text, test.options, got, test.want)
+		}
+	}
+}
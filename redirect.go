@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kiasaki/ush/parser"
+)
+
+// Opens the files targeted by redirects and points the state's streams at
+// them, in order, so that `>out 2>&1` and `2>&1 >out` behave differently.
+// Opened files are returned, even on error, so they can be closed once the
+// command is done.
+func (s *State) applyRedirects(redirects []*parser.Redirect) ([]*os.File, error) {
+	files := make([]*os.File, 0)
+	for _, redirect := range redirects {
+		switch redirect.Op {
+		case "<":
+			f, err := s.openFile(redirect.Target, os.O_RDONLY)
+			if err != nil {
+				return files, err
+			}
+			files = append(files, f)
+			if err := s.setInputStream(redirect.Fd, f); err != nil {
+				return files, err
+			}
+		case "<<", "<<-":
+			if err := s.setInputStream(redirect.Fd, strings.NewReader(redirect.Body)); err != nil {
+				return files, err
+			}
+		case "<<<":
+			if err := s.setInputStream(redirect.Fd, strings.NewReader(redirect.Target+"\n")); err != nil {
+				return files, err
+			}
+		case ">&":
+			fd, err := strconv.Atoi(redirect.Target)
+			if err != nil {
+				return files, fmt.Errorf("%s: bad file descriptor", redirect.Target)
+			}
+			w, err := s.outputStream(fd)
+			if err != nil {
+				return files, err
+			}
+			if err := s.setOutputStream(redirect.Fd, w); err != nil {
+				return files, err
+			}
+		case ">", ">>", "&>", "&>>":
+			flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			if redirect.Op == ">>" || redirect.Op == "&>>" {
+				flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+			}
+			f, err := s.openFile(redirect.Target, flags)
+			if err != nil {
+				return files, err
+			}
+			files = append(files, f)
+			if redirect.Op[0] == '&' {
+				s.stdout, s.stderr = f, f
+			} else if err := s.setOutputStream(redirect.Fd, f); err != nil {
+				return files, err
+			}
+		}
+	}
+	return files, nil
+}
+
+func (s *State) setInputStream(fd int, r io.Reader) error {
+	if fd != 0 {
+		return fmt.Errorf("%d: bad file descriptor", fd)
+	}
+	s.stdin = r
+	return nil
+}
+
+func (s *State) outputStream(fd int) (io.Writer, error) {
+	switch fd {
+	case 1:
+		return s.stdout, nil
+	case 2:
+		return s.stderr, nil
+	}
+	return nil, fmt.Errorf("%d: bad file descriptor", fd)
+}
+
+func (s *State) setOutputStream(fd int, w io.Writer) error {
+	switch fd {
+	case 1:
+		s.stdout = w
+	case 2:
+		s.stderr = w
+	default:
+		return fmt.Errorf("%d: bad file descriptor", fd)
+	}
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// Opens a file relative to the shell's current directory, errors mentioning
+// its name as given
+func (s *State) openFile(name string, flags int) (*os.File, error) {
+	f, err := os.OpenFile(s.absPath(name), flags, 0666)
+	if pathErr, ok := err.(*os.PathError); ok {
+		pathErr.Path = name
+	}
+	return f, err
+}
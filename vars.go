@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kiasaki/ush/parser"
+)
+
+// Variable is a shell variable. Only exported ones are passed on to the
+// environment of commands.
+type Variable struct {
+	Value    string
+	Exported bool
+	ReadOnly bool
+	Unset    bool // true when declared by export or readonly without a value
+}
+
+// Imports the environment the shell was started with as exported variables
+func importEnviron() map[string]*Variable {
+	vars := map[string]*Variable{}
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			vars[kv[:i]] = &Variable{Value: kv[i+1:], Exported: true}
+		}
+	}
+	return vars
+}
+
+func (s *State) setVar(name, value string) error {
+	v, ok := s.Vars[name]
+	if !ok {
+		s.Vars[name] = &Variable{Value: value}
+		return nil
+	}
+	if v.ReadOnly {
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+	v.Value, v.Unset = value, false
+	return nil
+}
+
+// Sets a variable and exports it, unless it is read-only
+func (s *State) exportVar(name, value string) {
+	if s.setVar(name, value) == nil {
+		s.Vars[name].Exported = true
+	}
+}
+
+func (s *State) unsetVar(name string) error {
+	if v, ok := s.Vars[name]; ok && v.ReadOnly {
+		return fmt.Errorf("%s: cannot unset: readonly variable", name)
+	}
+	delete(s.Vars, name)
+	return nil
+}
+
+// Returns the exported variables, as the environment of a command
+func (s *State) environ() []string {
+	env := []string{}
+	for name, v := range s.Vars {
+		if v.Exported && !v.Unset {
+			env = append(env, name+"="+v.Value)
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// Copies the variables, so that a subshell can change them without the shell
+// seeing it
+func copyVars(vars map[string]*Variable) map[string]*Variable {
+	copied := make(map[string]*Variable, len(vars))
+	for name, v := range vars {
+		variable := *v
+		copied[name] = &variable
+	}
+	return copied
+}
+
+// Returns a copy of the state for commands running apart from the shell,
+// like subshells, command substitutions or builtins in a pipeline, whose
+// changes to the directory, variables, aliases, functions and options don't
+// last
+func (s *State) subshell() *State {
+	sub := *s
+	sub.isSubshell = true
+	sub.Aliases = make(map[string]string, len(s.Aliases))
+	for name, alias := range s.Aliases {
+		sub.Aliases[name] = alias
+	}
+	sub.Functions = make(map[string]*parser.FunctionDef, len(s.Functions))
+	for name, fn := range s.Functions {
+		sub.Functions[name] = fn
+	}
+	sub.Options = copyOptions(s.Options)
+	sub.ShellOptions = copyOptions(s.ShellOptions)
+	sub.Vars = copyVars(s.Vars)
+	sub.locals = make([]map[string]*Variable, len(s.locals))
+	for i, locals := range s.locals {
+		sub.locals[i] = copyVars(locals)
+	}
+	return &sub
+}
+
+func copyOptions(options map[string]bool) map[string]bool {
+	copied := make(map[string]bool, len(options))
+	for name, on := range options {
+		copied[name] = on
+	}
+	return copied
+}
+
+// Finds the program a command runs in the directories of the shell's $PATH,
+// commands containing a slash being used as is
+func (s *State) lookPath(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	for _, dir := range filepath.SplitList(s.getVar("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		path := dir + "/" + name
+		if info, err := os.Stat(s.absPath(path)); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+// Expands and sets the variables of a command made only of assignments, like
+// `a=1 b=$a`, from left to right. Its exit status is the one of the last
+// command substitution expanded.
+func (s *State) assign(assignments []*parser.Assignment) int {
+	failed := 0
+	for _, assignment := range assignments {
+		value, err := s.expandAssignment(assignment.ValueWord)
+		if err != nil {
+			return s.reportExpansionError(err)
+		}
+		if err := s.setVar(assignment.Name, value); err != nil {
+			failed = s.ReportCommandError("%v", err)
+		}
+	}
+	if failed != 0 {
+		return failed
+	}
+	return s.substitutionStatus
+}
+
+// Sets the variables assigned before a command, exported, stopping at the
+// first one that is read-only
+func (s *State) exportAssignments(assignments []*parser.Assignment) error {
+	for _, assignment := range assignments {
+		if v, ok := s.Vars[assignment.Name]; ok && v.ReadOnly {
+			return fmt.Errorf("%s: readonly variable", assignment.Name)
+		}
+		s.Vars[assignment.Name] = &Variable{Value: assignment.Value, Exported: true}
+	}
+	return nil
+}
+
+// Calls run with the variables assigned before a builtin or function set and
+// exported, restoring their previous values afterwards
+func (s *State) withAssignments(assignments []*parser.Assignment, run func() int) int {
+	saved := map[string]*Variable{}
+	for _, assignment := range assignments {
+		if _, ok := saved[assignment.Name]; !ok {
+			saved[assignment.Name] = s.Vars[assignment.Name]
+		}
+	}
+	defer func() {
+		for name, v := range saved {
+			if v != nil {
+				s.Vars[name] = v
+			} else {
+				delete(s.Vars, name)
+			}
+		}
+	}()
+
+	if err := s.exportAssignments(assignments); err != nil {
+		return s.ReportCommandError("%v", err)
+	}
+	return run()
+}
+
+// Handles `export name=value` and `export name`, exporting the variables,
+// and lists exported variables without arguments
+func (s *State) BuiltinExport(args []string) int {
+	if len(args) == 1 {
+		s.printVars(func(v *Variable) bool { return v.Exported }, "export")
+		return 0
+	}
+	return s.declare(args, func(v *Variable) { v.Exported = true })
+}
+
+// Handles `readonly name=value` and `readonly name`, making the variables
+// read-only, and lists read-only variables without arguments
+func (s *State) BuiltinReadonly(args []string) int {
+	if len(args) == 1 {
+		s.printVars(func(v *Variable) bool { return v.ReadOnly }, "readonly")
+		return 0
+	}
+	return s.declare(args, func(v *Variable) { v.ReadOnly = true })
+}
+
+// Sets the variables given as `name=value` arguments, or declares them for
+// plain names, then calls mark on each of them
+func (s *State) declare(args []string, mark func(*Variable)) int {
+	status := 0
+	for _, arg := range args[1:] {
+		name, value, hasValue := splitAssignment(arg)
+		if !isName(name) {
+			status = s.ReportCommandError("%s: `%s': not a valid identifier", args[0], arg)
+			continue
+		}
+		if hasValue {
+			if err := s.setVar(name, value); err != nil {
+				status = s.ReportCommandError("%s: %v", args[0], err)
+				continue
+			}
+		} else if _, ok := s.Vars[name]; !ok {
+			s.Vars[name] = &Variable{Unset: true}
+		}
+		mark(s.Vars[name])
+	}
+	return status
+}
+
+// Prints the variables for which filter returns true, sorted by name, as the
+// commands setting them
+func (s *State) printVars(filter func(*Variable) bool, command string) {
+	names := []string{}
+	for name, v := range s.Vars {
+		if filter(v) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if v := s.Vars[name]; v.Unset {
+			fmt.Fprintf(s.stdout, "%s %s\n", command, name)
+		} else {
+			fmt.Fprintf(s.stdout, "%s %s=%s\n", command, name, parser.Format(v.Value))
+		}
+	}
+}